@@ -0,0 +1,52 @@
+package squirrel
+
+import (
+	"context"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Starts checkpointing the WAL every NewCacheOpts.AutoCheckpointInterval, if it's set, until
+// stopAutoCheckpoint is called.
+func (c *Cache) startAutoCheckpoint() {
+	interval := c.opts.AutoCheckpointInterval
+	if interval <= 0 {
+		return
+	}
+	mode := c.opts.AutoCheckpointMode
+	if mode == "" {
+		mode = CheckpointPassive
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.stopAutoCheckpoint = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			c.autoCheckpoint(mode)
+		}
+	}()
+}
+
+func (c *Cache) autoCheckpoint(mode CheckpointMode) {
+	// PinnedBlobs hold transactions open, so checkpoints other than passive would wait for them,
+	// and hold up writers meanwhile. A conn might not even be available until they're closed.
+	if c.OpenPinnedCount() != 0 {
+		return
+	}
+	_, _, _, err := c.Checkpoint(mode)
+	if err != nil && !c.isClosed() {
+		c.opts.Logger.Levelf(log.Warning, "automatic checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Copies the database to a file at path using the sqlite online backup API, replacing anything
+// there. Reads and writes can continue during the backup, and the copy includes changes still in
+// the WAL and values buffered by write-behind.
+func (c *Cache) BackupTo(path string) error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	return c.withConn(func(c conn) (err error) {
+		dst, err := sqlite.OpenConn(path, openConnFlags&^sqlite.OpenURI)
+		if err != nil {
+			return
+		}
+		defer func() {
+			err = errors.Join(err, dst.Close())
+		}()
+		backup, err := c.sqliteConn.BackupInit("main", "main", dst.Conn)
+		if err != nil {
+			return
+		}
+		err = backup.Step(-1)
+		return errors.Join(err, backup.Finish())
+	})
+}
+
+// Writes a snapshot of the database to w, as would be created by BackupTo. The snapshot is staged
+// in a temporary file.
+func (c *Cache) BackupToWriter(w io.Writer) (err error) {
+	f, err := os.CreateTemp("", "squirrel-backup-*.db")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = c.BackupTo(f.Name())
+	if err != nil {
+		return fmt.Errorf("backing up to temporary file: %w", err)
+	}
+	_, err = io.Copy(w, f)
+	return
+}
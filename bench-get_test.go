@@ -178,3 +178,33 @@ func runNested(
 		}
 	}
 }
+
+// Reads a value in chunks through a PinnedBlob, as when hashing a torrent piece, to show
+// allocations per chunk.
+func BenchmarkPinnedBlobReadChunks(b *testing.B) {
+	const valueSize = 2 << 20
+	const chunkSize = 1 << 14
+	c := qt.New(b)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(b))
+	value := make([]byte, valueSize)
+	readRandSparse(value)
+	c.Assert(cache.Put(defaultKey, value), qt.IsNil)
+	pb, err := cache.OpenPinnedReadOnly(defaultKey)
+	c.Assert(err, qt.IsNil)
+	defer pb.Close()
+	buf := make([]byte, chunkSize)
+	b.SetBytes(valueSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < valueSize; off += chunkSize {
+			_, err := pb.ReadAt(buf, off)
+			if err != nil && !errors.Is(err, io.EOF) {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(testing.AllocsPerRun(1, func() {
+		pb.ReadAt(buf, 0)
+	})), "allocs/chunk")
+}
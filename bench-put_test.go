@@ -56,10 +56,10 @@ func BenchmarkPutSmallItem(b *testing.B) {
 		},
 		[]nestedBench{
 			{"SynchronousOff", func(opts *squirrel.NewCacheOpts) {
-				opts.SetSynchronous = 0
+				opts.SetSynchronous = squirrel.SynchronousOff
 			}},
 			{"SynchronousNormal", func(opts *squirrel.NewCacheOpts) {
-				opts.SetSynchronous = 1
+				opts.SetSynchronous = squirrel.SynchronousNormal
 			}},
 		},
 	)
@@ -93,7 +93,7 @@ func BenchmarkWriteVeryLargeBlob(b *testing.B) {
 	cacheOpts.LengthLimit.Set(valueLen - 1)
 	cacheOpts.MaxBlobSize.Set(1 << 23)
 	writeLargeValue := func(cache *squirrel.Cache) (err error) {
-		item, err := cache.Create(defaultKey, squirrel.CreateOpts{valueLen})
+		item, err := cache.Create(defaultKey, squirrel.CreateOpts{Length: valueLen})
 		if err != nil {
 			err = fmt.Errorf("creating cache item: %w", err)
 			return
@@ -133,7 +133,7 @@ func benchmarkTorrentStorage(
 
 func writeChunksSeparately(cache *squirrel.Cache, key []byte, off uint32, b []byte, pieceSize uint32) error {
 	key = binary.BigEndian.AppendUint32(key, off)
-	return cache.Put(string(key), b)
+	return cache.PutBytes(key, b)
 }
 
 func writeToOneBigPiece(cache *squirrel.Cache, key []byte, off uint32, b []byte, pieceSize uint32) error {
@@ -190,7 +190,7 @@ func readHashAndTagOneBigPiece(
 		panic(err)
 	}
 	defer blob.Close()
-	_, err = io.Copy(hash, io.NewSectionReader(blob, 0, blob.Length()))
+	_, err = io.CopyBuffer(hash, io.NewSectionReader(blob, 0, blob.Length()), buf)
 	return
 }
 
@@ -266,6 +266,16 @@ func benchmarkTorrentStorageVaryingChunksPiecesTransactions(
 			readAndHashSeparateChunks[*squirrel.Cache],
 		)
 	})
+	b.Run("IndividualChunksTransientStatements", func(b *testing.B) {
+		cacheOpts := newCacheOpts()
+		squirrel.TestingSetTransientStatements(&cacheOpts)
+		benchmarkTorrentStorage(
+			b,
+			cacheOpts,
+			writeChunksSeparately,
+			readAndHashSeparateChunks[*squirrel.Cache],
+		)
+	})
 	b.Run("IndividualChunksTransaction", func(b *testing.B) {
 		cacheOpts := newCacheOpts()
 		benchmarkTorrentStorage(
@@ -279,14 +289,10 @@ func benchmarkTorrentStorageVaryingChunksPiecesTransactions(
 				pieceSize int,
 				buf []byte,
 				hash io.Writer,
-			) (err error) {
-				err = errors.Join(
-					cache.Tx(
-						func(tx *squirrel.Tx) error {
-							return readAndHashSeparateChunks(tx, key, offIter, pieceSize, buf, hash)
-						}),
-					err)
-				return
+			) error {
+				return cache.Tx(func(tx *squirrel.Tx) error {
+					return readAndHashSeparateChunks(tx, key, offIter, pieceSize, buf, hash)
+				})
 			},
 		)
 	})
@@ -0,0 +1,29 @@
+package squirrel
+
+import (
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Returns the error to fail a blob read or write with, if any. op is "read" or "write", and off is
+// the offset in the blob.
+type blobIOFaultFunc func(op string, off int64) error
+
+func (conn conn) blobReadAt(blob *sqlite.Blob, b []byte, off int64) (n int, err error) {
+	if conn.blobIOFault != nil {
+		err = conn.blobIOFault("read", off)
+		if err != nil {
+			return
+		}
+	}
+	return blobReadAt(blob, b, off)
+}
+
+func (conn conn) blobWriteAt(blob *sqlite.Blob, b []byte, off int64) (n int, err error) {
+	if conn.blobIOFault != nil {
+		err = conn.blobIOFault("write", off)
+		if err != nil {
+			return
+		}
+	}
+	return blobWriteAt(blob, b, off)
+}
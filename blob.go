@@ -5,7 +5,6 @@ import (
 
 	g "github.com/anacrolix/generics"
 	sqlite "github.com/go-llsqlite/adapter"
-	"github.com/go-llsqlite/adapter/sqlitex"
 )
 
 // Blobs are references to a name in a Cache that are looked up when its methods are used. They
@@ -29,9 +28,34 @@ func (p Blob) ReadAt(b []byte, off int64) (n int, err error) {
 	return
 }
 
+// Reads the ranges of the value into dst contiguously. See Tx.ReadRanges.
+func (p Blob) ReadRanges(ranges []Range, dst []byte) error {
+	return p.cache.Tx(func(tx *Tx) error {
+		return tx.ReadRanges(p.name, ranges, dst)
+	})
+}
+
+// See Tx.WrittenRanges.
+func (p Blob) WrittenRanges() (ret []Range, err error) {
+	err = p.cache.Tx(func(tx *Tx) (err error) {
+		ret, err = tx.WrittenRanges(p.name)
+		return
+	})
+	return
+}
+
+// See Tx.IsComplete.
+func (p Blob) IsComplete() (complete bool, err error) {
+	err = p.cache.Tx(func(tx *Tx) (err error) {
+		complete, err = tx.IsComplete(p.name)
+		return
+	})
+	return
+}
+
 func (p Blob) WriteAt(b []byte, off int64) (n int, err error) {
 	err = p.cache.TxImmediate(func(tx *Tx) (err error) {
-		pb, err := tx.Create(p.name, CreateOpts{p.length.Unwrap()})
+		pb, err := tx.Create(p.name, CreateOpts{Length: p.length.Unwrap()})
 		if err != nil {
 			return
 		}
@@ -62,11 +86,7 @@ func (p Blob) GetTag(name string, result func(stmt SqliteStmt)) error {
 }
 
 func (b Blob) Delete() error {
-	return b.cache.Tx(func(tx *Tx) error {
-		return sqlitex.Execute(tx.conn.sqliteConn, "delete from blob where name=?", &sqlitex.ExecOptions{
-			Args: []interface{}{b.name},
-		})
-	})
+	return b.cache.Delete(b.name)
 }
 
 func (p Blob) Size() (l int64, err error) {
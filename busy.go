@@ -0,0 +1,45 @@
+package squirrel
+
+import (
+	"context"
+	"time"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+const resultCodeLocked = sqlite.ResultCode(6) // SQLITE_LOCKED
+
+func isBusyErr(err error) bool {
+	return sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeBusy) ||
+		sqlite.IsPrimaryResultCodeErr(err, resultCodeLocked)
+}
+
+// The delay before the first retry of a busy transaction. It doubles for each retry after.
+const busyRetryInitialDelay = time.Millisecond
+
+// Runs tx, and while it fails because the database is busy, retries it with exponential backoff
+// until NewCacheOpts.BusyTimeout has elapsed. tx also returns whether it's safe to run again.
+func (c *Cache) retryBusy(ctx context.Context, tx func() (rerunnable bool, err error)) (err error) {
+	if c.opts.BusyTimeout <= 0 {
+		_, err = tx()
+		return
+	}
+	deadline := time.Now().Add(c.opts.BusyTimeout)
+	delay := busyRetryInitialDelay
+	for {
+		var rerunnable bool
+		rerunnable, err = tx()
+		if !rerunnable || !isBusyErr(err) || time.Now().Add(delay).After(deadline) {
+			return
+		}
+		if c.opts.Observer != nil {
+			c.opts.Observer.OnBusyRetry()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
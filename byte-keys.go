@@ -0,0 +1,27 @@
+package squirrel
+
+// Keys are stored as text containing the key's bytes exactly, whether or not they're valid UTF-8,
+// so binary keys such as an infohash followed by a piece index can be used directly. A []byte key
+// refers to the same value as a string key with the same bytes: both are bound as text, since
+// SQLite never considers a BLOB equal to text. These are conveniences for callers that build keys as
+// []byte.
+
+// Like Put, with key given as bytes.
+func (c *Cache) PutBytes(key, value []byte) error {
+	return c.Put(string(key), value)
+}
+
+// Like Get, with key given as bytes.
+func (c *Cache) GetBytes(key []byte) ([]byte, error) {
+	return c.Get(string(key))
+}
+
+// Like ReadAll, with key given as bytes.
+func (c *Cache) ReadAllBytes(key, b []byte) ([]byte, error) {
+	return c.ReadAll(string(key), b)
+}
+
+// Like Delete, with key given as bytes.
+func (c *Cache) DeleteBytes(key []byte) error {
+	return c.Delete(string(key))
+}
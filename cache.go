@@ -1,6 +1,7 @@
 package squirrel
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/anacrolix/sync"
 
 	"github.com/ajwerner/btree"
+	"golang.org/x/sync/singleflight"
 
 	g "github.com/anacrolix/generics"
 	sqlite "github.com/go-llsqlite/adapter"
@@ -23,27 +25,140 @@ type NewCacheOpts struct {
 	// Cache.
 	ConnBlockedOnBusy *chan struct{}
 	Logger            log.Logger
+	// If set, this is called for operations that take at least SlowThreshold. Instrumented
+	// operations are "put", "read full", "tx" and "evict". key is empty for operations that aren't
+	// specific to a key.
+	SlowLog       func(op string, dur time.Duration, key string)
+	SlowThreshold time.Duration
+	// Record the stack of callers that open PinnedBlobs from the Cache, for PinnedBlobDebug.
+	TrackPinnedBlobCallers bool
+	// If set, Puts are buffered in memory and written in batches. Buffered values are visible to
+	// ReadFull and ReadAll. Transactions flush the buffer before they begin.
+	WriteBehind g.Option[WriteBehindOpts]
+	// Reading regions of sparse values that haven't been written returns ErrNotPresent instead of
+	// zeroes.
+	SparseReadsErr bool
+	// Run pragma optimize when the Cache is closed.
+	OptimizeOnClose bool
+	// If set, capacity is compared to the sum of the costs of the keys instead of the bytes used by
+	// the database. Costs are stored when keys are created or grow, so every Cache on a database
+	// should use the same CostFunc.
+	CostFunc CostFunc
+	// If the database file is corrupt or isn't a database, delete it and create a new one instead
+	// of returning ErrCorruptDatabase.
+	RecreateOnCorrupt bool
+	// The order keys are deleted when trimming to capacity. Every Cache on a database should use
+	// the same policy.
+	EvictionPolicy EvictionPolicy
+	// Compress values written with Put. Capacity applies to the compressed length, while lengths
+	// returned to callers are uncompressed. Compressed values can't be opened as PinnedBlobs.
+	Compression Compression
+	// Encrypt values written with Put. See BlobCrypter.
+	BlobCrypter BlobCrypter
+	// The maximum number of conns to the database, if positive. Conns are opened as needed for
+	// concurrent transactions, and each PinnedBlob holds one until it's closed. When the limit is
+	// reached, operations wait for a conn to be returned, so it must exceed the number of conns any
+	// goroutine holds at once.
+	MaxConns int
+	// Called with each key deleted when trimming to capacity, and the length of its value, after
+	// the transaction that deleted it commits. The callback can use the Cache, except while
+	// write-behind values are being flushed.
+	OnEvict func(key string, length int64)
+	// Like OnEvict, for indexed values. They're only deleted to get under Capacity, as they don't
+	// count toward MaxKeys.
+	OnEvictIndexed func(key string, index uint64, length int64)
+	// Receives events for monitoring, if set.
+	Observer Observer
+	// Stores a CRC-32C checksum for each blob written, and verifies blobs against it when they're
+	// read, returning ErrChecksumMismatch on failure. Blobs without a checksum, such as those
+	// written before this was set, aren't verified. Encrypted values aren't covered. Every conn
+	// writing to the database should set this, or checksums are dropped when blobs are written.
+	VerifyChecksums bool
+	// Values written with Put are stored once for each distinct content, and shared between keys.
+	// Deduplicated values can't be modified in place, and return ErrDeduplicated if attempted. This
+	// can't be used with BlobCrypter, as it would reveal which values are equal.
+	Dedup bool
+	// If positive, conns wait at most this long for locks held by other conns (see pragma
+	// busy_timeout), instead of until interrupted. Transactions that fail with SQLITE_BUSY or
+	// SQLITE_LOCKED are retried with exponential backoff until it has elapsed since the first
+	// attempt. Retrying calls the function passed to Tx again, so it must not have effects outside
+	// the Tx.
+	BusyTimeout time.Duration
+	// If set, returns the current time in milliseconds since the Unix epoch, for access times,
+	// creation times and expiries. SQLite's clock is used otherwise. This lets tests control
+	// eviction order without waiting for the clock to advance.
+	TimeSource func() int64
+	// If positive, the WAL is checkpointed with AutoCheckpointMode this often, until the Cache is
+	// closed. Checkpoints are skipped while PinnedBlobs are open. The database must be in WAL mode.
+	AutoCheckpointInterval time.Duration
+	// The mode for automatic checkpoints. The default is CheckpointPassive, which doesn't wait for
+	// readers or writers.
+	AutoCheckpointMode CheckpointMode
+	// Consulted before each blob read and write, which fail with the error it returns. Set with
+	// TestingSetBlobIOFault.
+	blobIOFault blobIOFaultFunc
+	// Prepare every statement anew instead of reusing it. Set with TestingSetTransientStatements.
+	transientStatements bool
 }
 
 func newConn(opts NewCacheOpts) (ret conn, err error) {
-	conn, err := newSqliteConn(opts.NewConnOpts)
+	sqliteConn, err := newSqliteConn(opts.NewConnOpts)
 	if err != nil {
 		return
 	}
+	ret, err = newConnFromSqlite(sqliteConn, opts)
+	if err != nil {
+		err = errors.Join(err, sqliteConn.Close())
+	}
+	return
+}
+
+// Wraps and initializes an open sqlite conn. The sqlite conn isn't closed on error.
+func newConnFromSqlite(sqliteConn sqliteConn, opts NewCacheOpts) (ret conn, err error) {
 	ret = new(connStruct)
-	ret.sqliteConn = conn
+	ret.sqliteConn = sqliteConn
 	ret.blobs = makeBlobCache()
+	ret.blobsIoIter = ret.blobsIo.iter
 	ret.maxBlobSize = opts.MaxBlobSize.UnwrapOr(defaultMaxBlobSize)
 	ret.logger = opts.Logger
-	err = initConn(ret, opts)
+	ret.readOnly = opts.readOnly()
+	ret.slowLog = opts.slowLogger()
+	ret.sparseReadsErr = opts.SparseReadsErr
+	ret.tablePrefix = opts.TablePrefix
+	ret.costFunc = opts.CostFunc
+	ret.compression = opts.Compression
+	ret.blobCrypter = opts.BlobCrypter
+	ret.verifyChecksums = opts.VerifyChecksums
+	ret.dedup = opts.Dedup
+	ret.blobIOFault = opts.blobIOFault
+	ret.transientStatements = opts.transientStatements
+	ret.timeSource = opts.TimeSource
+	ret.collectEvicted = opts.OnEvict != nil || opts.OnEvictIndexed != nil || opts.Observer != nil
+	ret.evictionPolicy = opts.EvictionPolicy
+	err = ret.checkMaxBlobSize()
+	if err == nil {
+		err = checkTablePrefix(opts.TablePrefix)
+	}
+	if err == nil && opts.Dedup && opts.BlobCrypter != nil {
+		err = errors.New("Dedup can't be used with BlobCrypter")
+	}
+	if err == nil && opts.AutoCheckpointMode != "" && !opts.AutoCheckpointMode.valid() {
+		err = fmt.Errorf("unknown checkpoint mode %q", opts.AutoCheckpointMode)
+	}
+	if err == nil {
+		err = initConn(ret, opts)
+	}
 	if err != nil {
-		err = errors.Join(err, ret.Close())
+		ret = nil
 	}
 	return
 }
 
 // Inits sqlite for a conn.
 func initConn(conn conn, opts NewCacheOpts) (err error) {
+	if opts.BusyTimeout > 0 {
+		conn.sqliteConn.SetBusyTimeout(opts.BusyTimeout)
+	}
 	if opts.ConnBlockedOnBusy != nil {
 		returned := make(chan struct{})
 		defer close(returned)
@@ -70,16 +185,25 @@ func initConn(conn conn, opts NewCacheOpts) (err error) {
 		err = fmt.Errorf("setting page size: %w", err)
 		return
 	}
-	// pragma auto_vacuum=X needs to occur before pragma journal_mode=wal
-	err = initDatabase(conn.sqliteConn, opts.InitDbOpts)
-	if err != nil {
-		return
+	// pragma auto_vacuum=X needs to occur before pragma journal_mode=wal. Read-only databases must
+	// already be initialized.
+	if !conn.readOnly {
+		err = initDatabase(conn, opts.InitDbOpts)
+		if err != nil {
+			return
+		}
+		if !opts.DontInitSchema {
+			err = conn.initEvictionIndex(opts.EvictionPolicy)
+			if err != nil {
+				return
+			}
+		}
 	}
-	err = initSqliteConn(conn.sqliteConn, opts.InitConnOpts, opts.PageSize)
+	err = initSqliteConn(conn.sqliteConn, opts.InitConnOpts, opts.PageSize, conn.readOnly)
 	if err != nil {
 		return
 	}
-	err = conn.trimToCapacity(nil)
+	_, _, err = conn.trimToCapacity()
 	if err != nil {
 		return
 	}
@@ -113,6 +237,34 @@ func makeBlobCache() btree.Map[valueKey, *sqlite.Blob] {
 }
 
 func NewCache(opts NewCacheOpts) (_ *Cache, err error) {
+	cl := &Cache{
+		opts:     opts,
+		ownsConn: true,
+	}
+	if cl.opts.Logger.IsZero() {
+		cl.opts.Logger = log.Default
+	}
+	cl.closeCond.L = &cl.l
+	conn, err := cl.newFirstConn()
+	if err != nil {
+		return
+	}
+	cl.defaultCapacity, err = conn.getCapacity()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	cl.addConn(conn)
+	cl.startAutoCheckpoint()
+	return cl, nil
+}
+
+// Returns a Cache that uses sqliteConn, initializing the schema in its database if necessary, so
+// squirrel's tables can live alongside others (see InitDbOpts.TablePrefix). The Cache uses only
+// this conn, so operations are serialized, and it isn't closed when the Cache is. Nothing else
+// should use the conn until the Cache is closed. NewConnOpts and MaxConns are ignored.
+func NewCacheFromConn(sqliteConn *sqlite.Conn, opts NewCacheOpts) (_ *Cache, err error) {
+	opts.MaxConns = 1
 	cl := &Cache{
 		opts: opts,
 	}
@@ -120,11 +272,16 @@ func NewCache(opts NewCacheOpts) (_ *Cache, err error) {
 		cl.opts.Logger = log.Default
 	}
 	cl.closeCond.L = &cl.l
-	conn, err := cl.newConn()
+	conn, err := newConnFromSqlite(sqliteConn, cl.opts)
+	if err != nil {
+		return
+	}
+	cl.defaultCapacity, err = conn.getCapacity()
 	if err != nil {
 		return
 	}
 	cl.addConn(conn)
+	cl.startAutoCheckpoint()
 	return cl, nil
 }
 
@@ -137,20 +294,58 @@ func (cl *Cache) addConn(conn conn) {
 }
 
 func (cl *Cache) GetCapacity() (ret int64, ok bool) {
-	err := cl.execWithConn(
-		"select value from setting where name='capacity'",
-		func(stmt *sqlite.Stmt) error {
-			ok = true
-			ret = stmt.ColumnInt64(0)
-			return nil
-		},
-	)
+	err := cl.withConn(func(c conn) error {
+		capacity, err := c.getCapacity()
+		ret, ok = capacity.Value, capacity.Ok
+		return err
+	})
 	if err != nil {
 		panic(err)
 	}
 	return
 }
 
+// How long WaitUnderCapacity waits between attempts to trim.
+const waitUnderCapacityInterval = 10 * time.Millisecond
+
+// Blocks until the bytes used (or the total cost, see NewCacheOpts.CostFunc) and the number of keys
+// are within their limits, or ctx is done. Trimming occurs at the end of write transactions, so
+// this triggers them while waiting.
+func (cl *Cache) WaitUnderCapacity(ctx context.Context) error {
+	trimmed := false
+	for {
+		var over bool
+		err := cl.withConn(func(c conn) (err error) {
+			capacity, err := c.getCapacity()
+			if err != nil {
+				return
+			}
+			maxKeys, err := c.getMaxKeys()
+			if err != nil {
+				return
+			}
+			overBytes, overKeys, err := c.overCapacity(capacity, maxKeys)
+			over = overBytes || overKeys
+			return
+		})
+		if err != nil || !over {
+			return err
+		}
+		if trimmed {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(waitUnderCapacityInterval):
+			}
+		}
+		err = cl.txImmediate(func(tx *Tx) error { return nil })
+		if err != nil {
+			return err
+		}
+		trimmed = true
+	}
+}
+
 func (cl *Cache) popConn() (ret conn) {
 	ret = cl.conns[len(cl.conns)-1]
 	cl.conns = cl.conns[:len(cl.conns)-1]
@@ -162,32 +357,59 @@ func (cl *Cache) pushConn(conn conn) {
 }
 
 func (cl *Cache) withConn(with func(conn) error) (err error) {
+	conn, err := cl.getConn()
+	if err != nil {
+		return
+	}
+	err = with(conn)
 	cl.l.Lock()
-	if len(cl.conns) == 0 {
-		cl.l.Unlock()
-		var conn conn
-		conn, err = cl.newConn()
+	cl.pushConn(conn)
+	cl.connsInUse--
+	cl.closeCond.Broadcast()
+	cl.l.Unlock()
+	return
+}
+
+// Takes an idle conn, or opens a new one if NewCacheOpts.MaxConns allows, waiting for one to be
+// returned otherwise. The conn is counted as in use.
+func (cl *Cache) getConn() (conn conn, err error) {
+	cl.l.Lock()
+	defer cl.l.Unlock()
+	for {
+		if cl.replacing {
+			cl.closeCond.Wait()
+			continue
+		}
+		err = cl.getCacheErr()
 		if err != nil {
 			return
 		}
-		cl.l.Lock()
-		cl.addConn(conn)
+		if len(cl.conns) != 0 {
+			conn = cl.popConn()
+			cl.connsInUse++
+			return
+		}
+		if cl.opts.MaxConns <= 0 || cl.connsInUse < cl.opts.MaxConns {
+			break
+		}
+		cl.closeCond.Wait()
 	}
-	conn := cl.popConn()
+	// Count the conn as in use while it's opened, so MaxConns isn't exceeded.
 	cl.connsInUse++
+	opts := cl.opts
 	cl.l.Unlock()
-	err = with(conn)
+	conn, err = newConn(opts)
 	cl.l.Lock()
-	cl.pushConn(conn)
-	cl.connsInUse--
-	cl.closeCond.Broadcast()
-	cl.l.Unlock()
+	if err != nil {
+		cl.connsInUse--
+		cl.closeCond.Broadcast()
+	}
 	return
 }
 
 func (cl *Cache) execWithConn(query string, result func(stmt *sqlite.Stmt) error) (err error) {
 	return cl.withConn(func(c conn) error {
-		return sqlitex.Exec(c.sqliteConn, query, result)
+		return c.sqliteQuery(query, result)
 	})
 }
 
@@ -198,9 +420,24 @@ type Cache struct {
 	opts       NewCacheOpts
 	closeCond  sync.Cond
 	closed     bool
+	// Whether the Cache opened its conns, and so closes them. Otherwise it was given a single conn
+	// by NewCacheFromConn.
+	ownsConn bool
+	// Set while ReplaceWith is waiting for conns to be returned.
+	replacing bool
 	// Anytime we know that we have to write to the sqlite conn, we should try to synchronize on a
 	// single connection for cache re-use and to minimize busy waits on multiple connections.
 	singleWriter sync.Mutex
+	// PinnedBlobs opened from the Cache that haven't been closed, and the stack of their caller if
+	// it's being tracked.
+	pinnedBlobs map[*PinnedBlob]string
+	writeBehind writeBehind
+	// Calls to load values for GetOrLoad in progress, by key.
+	loads singleflight.Group
+	// Stops automatic checkpoints and waits for any in progress, if they were started.
+	stopAutoCheckpoint func()
+	// The capacity once the Cache was opened, which SetCapacity(0) restores. None is unlimited.
+	defaultCapacity g.Option[int64]
 }
 
 func (c *Cache) getCacheErr() error {
@@ -210,14 +447,27 @@ func (c *Cache) getCacheErr() error {
 	return nil
 }
 
-func (c *Cache) Close() (err error) {
+func (c *Cache) Close() error {
+	return c.CloseOpts(CloseOpts{})
+}
+
+func (c *Cache) isClosed() bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.closed
+}
+
+func (c *Cache) closeConns() (err error) {
 	c.l.Lock()
 	defer c.l.Unlock()
 	if !c.closed {
 		c.closed = true
 		for {
 			for len(c.conns) != 0 {
-				err = errors.Join(err, c.popConn().Close())
+				conn := c.popConn()
+				if c.ownsConn {
+					err = errors.Join(err, conn.Close())
+				}
 			}
 			if c.connsInUse == 0 {
 				break
@@ -232,7 +482,7 @@ func (c *Cache) Close() (err error) {
 // with it.
 func (c *Cache) OpenPinnedReadOnly(name string) (ret CachePinnedBlob, err error) {
 	return c.getPinnedBlob(
-		c.Tx,
+		c.txOnce,
 		func(tx *Tx) (*PinnedBlob, error) {
 			return tx.OpenPinnedReadOnly(name)
 		})
@@ -241,12 +491,43 @@ func (c *Cache) OpenPinnedReadOnly(name string) (ret CachePinnedBlob, err error)
 // Returns a PinnedBlob with its own implied Tx.
 func (c *Cache) Create(name string, opts CreateOpts) (ret CachePinnedBlob, err error) {
 	return c.getPinnedBlob(
-		c.TxImmediate,
+		c.txImmediateOnce,
 		func(tx *Tx) (*PinnedBlob, error) {
 			return tx.Create(name, opts)
 		})
 }
 
+// Returns a writable PinnedBlob for the value, after extending it to at least minLength. The value
+// is created if it doesn't exist.
+func (c *Cache) OpenPinnedWritable(name string, minLength int64) (ret CachePinnedBlob, err error) {
+	return c.getPinnedBlob(
+		c.txImmediateOnce,
+		func(tx *Tx) (*PinnedBlob, error) {
+			return tx.OpenPinnedWritable(name, minLength)
+		})
+}
+
+// Reserves storage for a value of length that's about to be written, and returns a writable
+// PinnedBlob for it. See Tx.Reserve. The reservation and the PinnedBlob share a transaction, and
+// other keys are evicted to make room for the reservation before it's written. Nothing is kept if
+// the PinnedBlob can't be opened.
+func (c *Cache) Reserve(key string, length int64) (ret CachePinnedBlob, err error) {
+	return c.getPinnedBlob(
+		c.txImmediateOnce,
+		func(tx *Tx) (pb *PinnedBlob, err error) {
+			err = tx.Reserve(key, length)
+			if err != nil {
+				return
+			}
+			_, _, err = tx.conn.trimToCapacity()
+			if err != nil {
+				return
+			}
+			return tx.OpenPinnedWritable(key, length)
+		},
+	)
+}
+
 // Returns a PinnedBlob with an automatic Tx. The Tx is closed when the returned value is Closed.
 func (c *Cache) getPinnedBlob(
 	getTx func(f func(tx *Tx) error) error,
@@ -254,10 +535,12 @@ func (c *Cache) getPinnedBlob(
 ) (ret CachePinnedBlob, err error) {
 	ready := make(chan struct{})
 	ret.txFinished = make(chan struct{})
-	closed := false
+	ret.txErr = new(error)
+	pinned := false
+	caller := c.pinnedBlobCaller()
 	go func() {
 		defer close(ret.txFinished)
-		err = getTx(func(tx *Tx) (err error) {
+		txErr := getTx(func(tx *Tx) (err error) {
 			pb, err := fromTx(tx)
 			if err != nil {
 				return
@@ -270,18 +553,20 @@ func (c *Cache) getPinnedBlob(
 				})
 			}
 			ret.PinnedBlob = pb
+			c.addPinnedBlob(pb, caller)
+			defer c.removePinnedBlob(pb)
+			pinned = true
 			close(ready)
-			closed = true
 			<-finishTx
 			return nil
 		})
-		if err != nil {
-			if closed {
-				panic(err)
-			}
-			closed = true
-			close(ready)
+		if pinned {
+			// Such as the commit failing. It's returned from Close.
+			*ret.txErr = txErr
+			return
 		}
+		err = txErr
+		close(ready)
 	}()
 	<-ready
 	return
@@ -296,22 +581,29 @@ type CachePinnedBlob struct {
 	// transaction with a Cache, not see conn returned, and create a new one that gets SQLITE_BUSY
 	// when it tries to upgrade to write.
 	txFinished chan struct{}
+	// The error ending the transaction, once txFinished is closed.
+	txErr *error
 }
 
 func (me CachePinnedBlob) Close() (err error) {
 	err = me.PinnedBlob.Close()
 	me.finishTx()
 	<-me.txFinished
-	return
+	return errors.Join(err, *me.txErr)
 }
 
 // Returns a PinnedBlob. The item must already exist. You must call PinnedBlob.Close when done
 // with it.
 func (tx *Tx) openPinned(name string, write bool) (ret *PinnedBlob, err error) {
-	valueId, err := tx.conn.getValueIdForKey(name)
+	cols, err := tx.conn.openKey(name)
 	if err != nil {
 		return
 	}
+	err = cols.checkPinnable()
+	if err != nil {
+		return
+	}
+	valueId := cols.id
 	ret = &PinnedBlob{
 		key:     name,
 		tx:      tx,
@@ -343,47 +635,140 @@ func (c *Cache) OpenWithLength(name string, length int64) Blob {
 	return c.BlobWithLength(name, length)
 }
 
+// Replaces the value for name with b. Keys are stored as text containing the key's bytes exactly,
+// whether or not they're valid UTF-8, so binary keys such as an infohash followed by a piece index
+// can be used. See PutBytes for keys built as []byte.
 func (c *Cache) Put(name string, b []byte) (err error) {
-	txErr := c.TxImmediate(func(tx *Tx) error {
-		return tx.Put(name, b)
-	})
-	return errors.Join(err, txErr)
+	return c.PutContext(context.Background(), name, b)
 }
 
 func (c *Cache) ReadFull(key string, b []byte) (n int, err error) {
-	err = c.wrapTxMethod(func(tx *Tx) error {
-		n, err = tx.ReadFull(key, b)
-		return err
+	return c.ReadFullContext(context.Background(), key, b)
+}
+
+func (c *Cache) ReadAll(key string, b []byte) (ret []byte, err error) {
+	return c.ReadAllContext(context.Background(), key, b)
+}
+
+// Marks key as accessed without reading it. See Tx.Touch.
+func (c *Cache) Touch(key string) error {
+	if _, ok := c.writeBehind.get(key); ok {
+		// It'll be accessed when it's written.
+		return nil
+	}
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.Touch(key)
+	})
+}
+
+// Returns the value for key in a new slice. See Tx.Get.
+func (c *Cache) Get(key string) (b []byte, err error) {
+	defer func() { c.observeRead(key, err) }()
+	if value, ok := c.writeBehind.get(key); ok {
+		return append([]byte{}, value...), nil
+	}
+	err = c.wrapTxMethod(func(tx *Tx) (err error) {
+		b, err = tx.Get(key)
+		return
 	})
 	return
 }
 
-func (c *Cache) ReadAll(key string, b []byte) (ret []byte, err error) {
+// Returns whether key exists, without counting as an access for eviction.
+func (c *Cache) Exists(key string) (exists bool, err error) {
+	if _, ok := c.writeBehind.get(key); ok {
+		return true, nil
+	}
 	err = c.wrapTxMethod(func(tx *Tx) error {
-		ret, err = tx.ReadAll(key, b)
+		_, err := tx.conn.openKey(key)
+		exists = err == nil
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
 		return err
 	})
 	return
 }
 
 func (c *Cache) runTx(f func(tx *Tx) error, level string) (err error) {
+	return c.runTxContext(context.Background(), f, level)
+}
+
+// Runs f in a transaction that is interrupted and rolled back if ctx is done. Immediate
+// transactions hold the single writer lock.
+func (c *Cache) runTxContext(ctx context.Context, f func(tx *Tx) error, level string) (err error) {
+	return c.runTxRetrying(ctx, f, level, true)
+}
+
+// Like runTx, but f is run at most once, for callers where f has effects outside the Tx. A busy
+// transaction is only retried if f wasn't called.
+func (c *Cache) runTxOnce(f func(tx *Tx) error, level string) (err error) {
+	return c.runTxRetrying(context.Background(), f, level, false)
+}
+
+func (c *Cache) runTxRetrying(
+	ctx context.Context,
+	f func(tx *Tx) error,
+	level string,
+	rerunF bool,
+) (err error) {
+	var evicted []evictedKey
+	called := false
+	err = c.retryBusy(ctx, func() (rerunnable bool, err error) {
+		evicted, err = c.runTxEvicting(ctx, func(tx *Tx) error {
+			called = true
+			return f(tx)
+		}, level)
+		return rerunF || !called, err
+	})
+	// After the conn and write lock are released, so the callback can use the Cache.
+	for _, e := range evicted {
+		c.observeEvict(e)
+	}
+	return
+}
+
+// Returns the keys evicted by the transaction if it commits and NewCacheOpts.OnEvict is set.
+func (c *Cache) runTxEvicting(ctx context.Context, f func(tx *Tx) error, level string) (
+	evicted []evictedKey, err error,
+) {
+	if level == "immediate" {
+		c.singleWriter.Lock()
+		defer c.singleWriter.Unlock()
+	}
+	defer c.opts.slowLogger().check("tx", "", time.Now())
 	err = c.withConn(func(c conn) (err error) {
+		if ctx.Done() != nil {
+			c.sqliteConn.SetInterrupt(ctx.Done())
+			// Don't leak the interrupt into the conn's next use.
+			defer c.sqliteConn.SetInterrupt(nil)
+		}
 		err = sqlitex.Exec(c.sqliteConn, "begin "+level, nil)
 		if err != nil {
 			return
 		}
+		// Other conns may have changed these since our last transaction.
+		c.hasBlobHashes.SetNone()
+		c.hasBlobChecksums.SetNone()
+		c.unchecksummedBlobs = nil
+		defer c.deleteExpiredKeys()
+		defer func() {
+			if err == nil {
+				evicted = c.evictedKeys
+			}
+			c.evictedKeys = nil
+		}()
 		tx := Tx{
 			conn:  c,
 			write: level != "",
 		}
 		err = f(&tx)
 		c.closeBlobs()
-		// TODO: Only trim when added to the database, or know that we upgraded to a write transaction already?
 		if err == nil {
-			err = c.trimToCapacity(func(key rowid) {
-				delete(tx.accessedKeys, key)
-			})
+			err = c.storeBlobChecksums()
 		}
+		// Access is applied before trimming, so that keys used in this transaction aren't evicted
+		// in favour of older ones. Otherwise new keys are the first to go under EvictLFU.
 		if err == nil {
 			for keyId := range tx.accessedKeys {
 				var ignored bool
@@ -393,9 +778,19 @@ func (c *Cache) runTx(f func(tx *Tx) error, level string) (err error) {
 				}
 			}
 		}
+		// TODO: Only trim when added to the database, or know that we upgraded to a write transaction already?
+		if err == nil {
+			_, _, err = c.trimToCapacity()
+		}
 		if err == nil {
 			err = sqlitex.Exec(c.sqliteConn, "commit", nil)
-			return
+			if err == nil {
+				return
+			}
+		}
+		if ctx.Done() != nil {
+			// The rollback must not be interrupted.
+			c.sqliteConn.SetInterrupt(nil)
 		}
 		// Autocommit is re-enabled if a transaction is automatically rolled back such as by SQLITE_FULL.
 		if !c.sqliteConn.GetAutocommit() {
@@ -406,33 +801,77 @@ func (c *Cache) runTx(f func(tx *Tx) error, level string) (err error) {
 		}
 		return
 	})
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	return
 }
 
+// Runs f in a deferred transaction. Values buffered for write-behind are flushed first. The Tx
+// sees its own writes. If f returns an error, the transaction is rolled back and the error is
+// returned, otherwise it's committed.
 func (c *Cache) Tx(f func(tx *Tx) error) (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
 	return c.runTx(f, "")
 }
 
+// Runs f in an immediate transaction, which takes the write lock when it begins instead of when it
+// first writes. Values buffered for write-behind are flushed first. See Tx.
 func (c *Cache) TxImmediate(f func(tx *Tx) error) (err error) {
-	c.singleWriter.Lock()
-	defer c.singleWriter.Unlock()
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.txImmediate(f)
+}
+
+func (c *Cache) txImmediate(f func(tx *Tx) error) (err error) {
 	return c.runTx(f, "immediate")
 }
 
+// Like Tx, but f isn't run again if the transaction is busy. See runTxOnce.
+func (c *Cache) txOnce(f func(tx *Tx) error) (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.runTxOnce(f, "")
+}
+
+// Like TxImmediate, but f isn't run again if the transaction is busy. See runTxOnce.
+func (c *Cache) txImmediateOnce(f func(tx *Tx) error) (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.runTxOnce(f, "immediate")
+}
+
 func (c *Cache) SetTag(key, name string, value interface{}) (err error) {
 	return c.TxImmediate(func(tx *Tx) error {
 		return tx.SetTag(key, name, value)
 	})
 }
 
+// Removes the tag from key. See Tx.DeleteTag.
+func (c *Cache) DeleteTag(key, name string) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.DeleteTag(key, name)
+	})
+}
+
+// Runs a read-only Tx method without flushing write-behind values.
 func (c *Cache) wrapTxMethod(txCall func(tx *Tx) error) error {
-	return c.Tx(func(tx *Tx) error {
+	return c.runTx(func(tx *Tx) error {
 		return txCall(tx)
-	})
+	}, "")
 }
 
-func openSqliteBlob(sc sqliteConn, rowid rowid, write bool) (*sqlite.Blob, error) {
-	return sc.OpenBlob("main", "blobs", "blob", rowid, write)
+func openSqliteBlob(sc sqliteConn, table string, rowid rowid, write bool) (*sqlite.Blob, error) {
+	return sc.OpenBlob("main", table, "blob", rowid, write)
 }
 
 func timeFromStmtColumn(stmt *sqlite.Stmt, col int) time.Time {
@@ -476,3 +915,34 @@ func (c conn) lastUsedByKey(key string) (lastUsed time.Time, err error) {
 	}
 	return
 }
+
+// Collects the keys returned in the first column of query, and then calls f with each of them. f
+// is called after the query has completed, so it's safe for it to use the Cache. Write-behind
+// values are flushed first so they're included.
+func (cl *Cache) iterKeysQuery(query string, f func(key string) error, args ...any) (err error) {
+	err = cl.Flush()
+	if err != nil {
+		return
+	}
+	var keys []string
+	err = cl.withConn(func(c conn) error {
+		return c.sqliteQuery(
+			query,
+			func(stmt *sqlite.Stmt) error {
+				keys = append(keys, stmt.ColumnText(0))
+				return nil
+			},
+			args...,
+		)
+	})
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		err = f(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package squirrel
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returned when a blob doesn't match its stored checksum, if NewCacheOpts.VerifyChecksums is set.
+type ErrChecksumMismatch struct {
+	Key string
+	// The offset in the value of the blob that didn't match.
+	Offset int64
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch in value for %q in blob at offset %v", e.Key, e.Offset)
+}
+
+// The blobs in the value overlapping [?2, ?3).
+const blobsInRangeWhere = `
+	value_id=?1 and offset<?3 and offset>=(
+		select coalesce(max(offset), 0) from "values" where value_id=?1 and offset<=?2
+	)`
+
+// Forgets the checksums of blobs overlapping [start, end) in the value, before they're written.
+func (conn conn) invalidateBlobChecksums(valueId rowid, start, end int64) error {
+	// There's nothing to forget unless checksums have been stored, by this or another conn.
+	has, err := conn.tableHasRows("blob_checksums", &conn.hasBlobChecksums)
+	if err != nil || !has {
+		return err
+	}
+	return conn.sqliteExec(
+		`delete from blob_checksums where blob_id in (
+			select blob_id from "values" where `+blobsInRangeWhere+`
+		)`,
+		valueId, start, end,
+	)
+}
+
+// Notes the blobs overlapping [start, end) in the value, which have been written, so their
+// checksums are stored when the transaction ends.
+func (conn conn) addUnchecksummedBlobs(valueId rowid, start, end int64) error {
+	return conn.sqliteQuery(
+		`select blob_id from "values" where `+blobsInRangeWhere,
+		func(stmt *sqlite.Stmt) error {
+			g.MakeMapIfNilAndSet(&conn.unchecksummedBlobs, stmt.ColumnInt64(0), struct{}{})
+			return nil
+		},
+		valueId, start, end,
+	)
+}
+
+// Computes and stores the checksums of blobs written in the transaction. Each blob is read once,
+// however many times it was written.
+func (conn conn) storeBlobChecksums() (err error) {
+	for blobId := range conn.unchecksummedBlobs {
+		var checksum uint32
+		var ok bool
+		ok, err = conn.sqliteQueryRow(
+			`select blob from blobs where blob_id=?`,
+			func(stmt *sqlite.Stmt) error {
+				checksum = crc32.Checksum(stmtColumnViewBytes(stmt, 0), castagnoliTable)
+				return nil
+			},
+			blobId,
+		)
+		if err != nil {
+			return
+		}
+		if !ok {
+			// It was deleted after being written.
+			continue
+		}
+		err = conn.sqliteExec(
+			`insert or replace into blob_checksums (blob_id, checksum) values (?, ?)`,
+			blobId, int64(checksum),
+		)
+		if err != nil {
+			return
+		}
+		conn.hasBlobChecksums.Set(true)
+	}
+	conn.unchecksummedBlobs = nil
+	return
+}
+
+// Checks the blob at offset in the value against its stored checksum.
+func (conn conn) verifyBlobChecksum(valueId rowid, offset int64, blob *sqlite.Blob, checksum uint32) (err error) {
+	if int64(cap(conn.checksumBuf)) < blob.Size() {
+		conn.checksumBuf = make([]byte, blob.Size())
+	}
+	b := conn.checksumBuf[:blob.Size()]
+	n, err := conn.blobReadAt(blob, b, 0)
+	if n == len(b) && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	if crc32.Checksum(b, castagnoliTable) == checksum {
+		return nil
+	}
+	mismatch := ErrChecksumMismatch{Offset: offset}
+	err = conn.sqliteQueryMaxOneRow(
+		`select coalesce(key, '') from keys where key_id=?`,
+		func(stmt *sqlite.Stmt) error {
+			mismatch.Key = stmt.ColumnText(0)
+			return nil
+		},
+		valueId,
+	)
+	if err != nil {
+		return
+	}
+	return mismatch
+}
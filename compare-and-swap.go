@@ -0,0 +1,37 @@
+package squirrel
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Puts newValue for key if the current value is equal to oldValue, in a single immediate
+// transaction. A missing key matches a nil oldValue, so this can also be used to create a key only
+// if it doesn't exist.
+func (c *Cache) CompareAndSwap(key string, oldValue, newValue []byte) (swapped bool, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		swapped, err = tx.CompareAndSwap(key, oldValue, newValue)
+		return
+	})
+	if err != nil {
+		swapped = false
+	}
+	return
+}
+
+func (tx *Tx) CompareAndSwap(key string, oldValue, newValue []byte) (swapped bool, err error) {
+	cur, err := tx.ReadAll(key, nil)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if oldValue != nil {
+			return false, nil
+		}
+	case err != nil:
+		return
+	case oldValue == nil || !bytes.Equal(cur, oldValue):
+		return false, nil
+	}
+	err = tx.Put(key, newValue)
+	swapped = err == nil
+	return
+}
@@ -12,3 +12,8 @@ func blobReadAt(blob *sqlite.Blob, b []byte, off int64) (n int, err error) {
 func blobWriteAt(blob *sqlite.Blob, b []byte, off int64) (n int, err error) {
 	return blob.WriteAt(b, off)
 }
+
+// Returns a view of the column that's valid until the statement is stepped or reset.
+func stmtColumnViewBytes(stmt *sqlite.Stmt, col int) []byte {
+	return stmt.ColumnViewBytes(col)
+}
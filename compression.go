@@ -0,0 +1,114 @@
+package squirrel
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// How values are compressed when they're stored. Values are only stored compressed if that makes
+// them smaller. The algorithm is recorded per key, so Caches with different settings can share a
+// database.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	// DEFLATE from compress/flate. zstd isn't offered to avoid the dependency.
+	CompressionFlate
+)
+
+// Returned when opening a compressed value as a PinnedBlob, or modifying it in place, as the
+// stored bytes don't correspond to the value's offsets.
+var ErrCompressed = errors.New("value is compressed")
+
+func (c Compression) compress(b []byte) (ret []byte, err error) {
+	switch c {
+	case CompressionFlate:
+		var buf bytes.Buffer
+		var w *flate.Writer
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return
+		}
+		_, err = w.Write(b)
+		if err == nil {
+			err = w.Close()
+		}
+		ret = buf.Bytes()
+		return
+	default:
+		err = fmt.Errorf("unknown compression %v", c)
+		return
+	}
+}
+
+// Decompresses b into ret, which must be the uncompressed length of b.
+func (c Compression) decompress(b []byte, ret []byte) (err error) {
+	switch c {
+	case CompressionFlate:
+		r := flate.NewReader(bytes.NewReader(b))
+		_, err = io.ReadFull(r, ret)
+		if err != nil {
+			return
+		}
+		return r.Close()
+	default:
+		return fmt.Errorf("unknown compression %v", c)
+	}
+}
+
+// Returns the bytes to store for b, which are compressed if that makes them smaller.
+func (conn conn) compressValue(b []byte) (stored []byte, compression Compression, err error) {
+	stored = b
+	if conn.compression == CompressionNone || len(b) == 0 {
+		return
+	}
+	compressed, err := conn.compression.compress(b)
+	if err != nil {
+		return
+	}
+	if len(compressed) < len(b) {
+		stored = compressed
+		compression = conn.compression
+	}
+	return
+}
+
+func (conn conn) storeKeyCompression(keyId rowid, compression Compression, uncompressedLength int64) error {
+	if compression == CompressionNone {
+		return nil
+	}
+	return conn.sqliteExec(
+		"insert into key_compression (key_id, compression, uncompressed_length) values (?, ?, ?)",
+		keyId,
+		compression,
+		uncompressedLength,
+	)
+}
+
+// Reads values that are compressed, encrypted or deduplicated, which must be read in full.
+func (tx *Tx) readFullDecoded(key keyCols, b []byte) (n int, err error) {
+	if key.deduped != nil {
+		key = *key.deduped
+	}
+	value, err := tx.conn.readStored(key)
+	if err != nil {
+		return
+	}
+	if key.compression != CompressionNone {
+		compressed := value
+		value = make([]byte, key.uncompressedLength)
+		err = key.compression.decompress(compressed, value)
+		if err != nil {
+			err = fmt.Errorf("decompressing: %w", err)
+			return
+		}
+	}
+	n = copy(b, value)
+	if n < len(b) {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
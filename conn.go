@@ -7,6 +7,8 @@ import (
 	g "github.com/anacrolix/generics"
 	"github.com/anacrolix/log"
 	"net/url"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/ajwerner/btree"
@@ -22,6 +24,44 @@ type connStruct struct {
 	blobs       btree.Map[valueKey, *sqlite.Blob]
 	maxBlobSize maxBlobSizeType
 	logger      log.Logger
+	// Don't attempt any writes.
+	readOnly bool
+	slowLog  slowLogger
+	// Return ErrNotPresent for unwritten regions of sparse values.
+	sparseReadsErr bool
+	tablePrefix    string
+	costFunc       CostFunc
+	compression    Compression
+	blobCrypter    BlobCrypter
+	evictionPolicy EvictionPolicy
+	// Deduplicate values written with Put.
+	dedup bool
+	// Store checksums of written blobs, and verify blobs that have them when they're opened.
+	verifyChecksums bool
+	// Injects blob I/O errors for testing.
+	blobIOFault blobIOFaultFunc
+	// Don't reuse prepared statements, for comparison in benchmarks.
+	transientStatements bool
+	timeSource          func() int64
+	// Reused by blobsIoAt. blobsIoIter is blobsIo.iter, bound once.
+	blobsIo     blobsIoState
+	blobsIoIter func(blobOff int64, blob *sqlite.Blob) (more bool, err error)
+	// Reused for reading whole blobs to verify their checksums.
+	checksumBuf []byte
+	// Keys found to have expired in the current transaction.
+	expiredKeys []rowid
+	// Whether blob_hashes and blob_checksums have any rows, once checked in the current
+	// transaction.
+	hasBlobHashes    g.Option[bool]
+	hasBlobChecksums g.Option[bool]
+	// Blobs written in the current transaction, that need their checksums stored before it commits.
+	unchecksummedBlobs map[rowid]struct{}
+	// Collect evictedKeys, for NewCacheOpts.OnEvict and Observer.
+	collectEvicted bool
+	// Keys evicted in the current transaction.
+	evictedKeys []evictedKey
+	// Queries with the table prefix applied, by the original query.
+	prefixedQueries map[string]string
 }
 
 func (c conn) Close() error {
@@ -30,8 +70,9 @@ func (c conn) Close() error {
 
 type conn = *connStruct
 
-func initSqliteConn(conn sqliteConn, opts InitConnOpts, pageSize int) (err error) {
-	if opts.SetJournalMode != "" {
+func initSqliteConn(conn sqliteConn, opts InitConnOpts, pageSize int, readOnly bool) (err error) {
+	// Changing the journal mode requires writing to the database.
+	if opts.SetJournalMode != "" && !readOnly {
 		journalMode, err := execTransientReturningText(
 			conn,
 			fmt.Sprintf(`pragma journal_mode=%s`, opts.SetJournalMode),
@@ -75,24 +116,74 @@ func initSqliteConn(conn sqliteConn, opts InitConnOpts, pageSize int) (err error
 			return
 		}
 	}
+	if opts.SoftHeapLimit.Ok {
+		err = setAndVerifyPragma(conn, "soft_heap_limit", opts.SoftHeapLimit.Value)
+		if err != nil {
+			return
+		}
+	}
+	if opts.TempStore.Ok {
+		err = setTempStore(conn, opts.TempStore.Value)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func setPageSize(conn sqliteConn, pageSize int) error {
+// Returned when the requested page size differs from that of an existing database. Changing it
+// requires a VACUUM, which isn't possible in WAL mode, so it's left to the caller.
+type ErrPageSizeImmutable struct {
+	Existing  int
+	Requested int
+}
+
+func (e ErrPageSizeImmutable) Error() string {
+	return fmt.Sprintf("database has page size %v, can't change it to %v", e.Existing, e.Requested)
+}
+
+func setPageSize(conn sqliteConn, pageSize int) (err error) {
 	if pageSize == 0 {
 		return nil
 	}
-	return setAndVerifyPragma(conn, "page_size", pageSize)
+	// SQLite ignores invalid page sizes.
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return ErrInvalidPragmaValue{Pragma: "page_size", Value: pageSize}
+	}
+	err = sqlitex.ExecTransient(conn, fmt.Sprintf("pragma page_size=%d", pageSize), nil)
+	if err != nil {
+		return
+	}
+	// The page size can only be changed before the database is created.
+	text, err := execTransientReturningText(conn, "pragma page_size")
+	if err != nil {
+		return
+	}
+	existing, err := strconv.Atoi(text.Value)
+	if err != nil {
+		return fmt.Errorf("parsing page size %q: %w", text.Value, err)
+	}
+	if existing != pageSize {
+		return ErrPageSizeImmutable{Existing: existing, Requested: pageSize}
+	}
+	return
 }
 
 var (
 	//go:embed init.sql
 	initScript string
+	// Currently empty. Capacity is enforced by trimToCapacity, and deleting a key cascades through
+	// foreign keys to all its "values" and blobs rows in one statement, however many there are.
 	//go:embed init-triggers.sql
 	initTriggers string
 )
 
 func InitSchema(conn sqliteConn, pageSize int, triggers bool) (err error) {
+	return initSchema(conn, pageSize, triggers, "")
+}
+
+// Initializes the schema with the table names prefixed. See InitDbOpts.TablePrefix.
+func initSchema(conn sqliteConn, pageSize int, triggers bool, tablePrefix string) (err error) {
 	err = setPageSize(conn, pageSize)
 	if err != nil {
 		return fmt.Errorf("setting page size: %w", err)
@@ -100,12 +191,26 @@ func InitSchema(conn sqliteConn, pageSize int, triggers bool) (err error) {
 	// By starting immediately into a write, we can block rather than get SQLITE_BUSY for trying to
 	// upgrade from a read later.
 	return sqlitex.WithTransactionRollbackOnError(conn, `immediate`, func() (err error) {
-		err = sqlitex.ExecScript(conn, initScript)
+		version, exists, err := getSchemaVersion(conn, tablePrefix)
+		if err != nil {
+			return
+		}
+		if exists {
+			err = migrate(conn, tablePrefix, version)
+			if err != nil {
+				return
+			}
+		}
+		err = sqlitex.ExecScript(conn, prefixTableNames(tablePrefix, initScript))
+		if err != nil {
+			return
+		}
+		err = setSchemaVersion(conn, tablePrefix)
 		if err != nil {
 			return
 		}
 		if triggers {
-			err = sqlitex.ExecScript(conn, initTriggers)
+			err = sqlitex.ExecScript(conn, prefixTableNames(tablePrefix, initTriggers))
 			if err != nil {
 				err = fmt.Errorf("initing triggers: %w", err)
 				return
@@ -116,34 +221,60 @@ func InitSchema(conn sqliteConn, pageSize int, triggers bool) (err error) {
 }
 
 // Remove any capacity limits.
-func unlimitCapacity(conn sqliteConn) error {
-	return sqlitex.Exec(conn, "delete from setting where name='capacity'", nil)
+func (conn conn) unlimitCapacity() error {
+	return conn.sqliteExec("delete from setting where name='capacity'")
 }
 
 // Set the capacity limit to exactly this value.
-func setCapacity(conn sqliteConn, cap int64) error {
-	return sqlitex.Exec(conn, "insert into setting values ('capacity', ?)", nil, cap)
+func (conn conn) setCapacity(cap int64) error {
+	return conn.sqliteExec("insert into setting values ('capacity', ?)", cap)
+}
+
+// Remove any limit on the number of keys.
+func (conn conn) unlimitMaxKeys() error {
+	return conn.sqliteExec("delete from setting where name='max_keys'")
+}
+
+// Set the maximum number of keys to exactly this value.
+func (conn conn) setMaxKeys(maxKeys int64) error {
+	return conn.sqliteExec("insert into setting values ('max_keys', ?)", maxKeys)
 }
 
-func newOpenUri(opts NewConnOpts) string {
+func newOpenUri(opts NewConnOpts) (string, error) {
 	path := url.PathEscape(opts.Path)
 	if opts.Memory {
 		path = ":memory:"
 	}
 	values := make(url.Values)
-	if opts.Memory {
+	if opts.MemoryName != "" {
+		path = url.PathEscape(opts.MemoryName)
+		values.Add("mode", "memory")
+	}
+	if opts.inMemory() {
 		values.Add("cache", "shared")
 	}
+	if opts.ImmutableFile {
+		values.Add("immutable", "1")
+	}
+	if opts.VFS != "" {
+		values.Add("vfs", opts.VFS)
+	}
+	for name, value := range opts.URIParams {
+		if values.Has(name) {
+			return "", fmt.Errorf("URI parameter %q conflicts with options", name)
+		}
+		values.Set(name, value)
+	}
 	// This still seems to use temporary databases as expected when there's just ?, so no need to
 	// special case empty paths and empty queries.
-	return fmt.Sprintf("file:%s?%s", path, values.Encode())
+	return fmt.Sprintf("file:%s?%s", path, values.Encode()), nil
 }
 
-func initDatabase(conn sqliteConn, opts InitDbOpts) (err error) {
+func initDatabase(conn conn, opts InitDbOpts) (err error) {
 	if opts.SetAutoVacuum.Ok {
 		// This needs to occur before setting journal mode to WAL.
 		err = setAndMaybeVerifyPragma(
-			conn,
+			conn.sqliteConn,
 			"auto_vacuum",
 			opts.SetAutoVacuum.Value,
 			opts.RequireAutoVacuum,
@@ -152,7 +283,7 @@ func initDatabase(conn sqliteConn, opts InitDbOpts) (err error) {
 			return err
 		}
 	} else if opts.RequireAutoVacuum.Ok {
-		autoVacuumValue, err := execTransientReturningText(conn, "pragma auto_vacuum")
+		autoVacuumValue, err := execTransientReturningText(conn.sqliteConn, "pragma auto_vacuum")
 		if err != nil {
 			return err
 		}
@@ -166,16 +297,24 @@ func initDatabase(conn sqliteConn, opts InitDbOpts) (err error) {
 		}
 	}
 	if !opts.DontInitSchema {
-		err = InitSchema(conn, opts.PageSize, !opts.NoTriggers)
+		err = initSchema(conn.sqliteConn, opts.PageSize, !opts.NoTriggers, opts.TablePrefix)
 		if err != nil {
 			err = fmt.Errorf("initing schema: %w", err)
 			return
 		}
 	}
 	if opts.Capacity < 0 {
-		err = unlimitCapacity(conn)
+		err = conn.unlimitCapacity()
 	} else if opts.Capacity > 0 {
-		err = setCapacity(conn, opts.Capacity)
+		err = conn.setCapacity(opts.Capacity)
+	}
+	if err != nil {
+		return
+	}
+	if opts.MaxKeys < 0 {
+		err = conn.unlimitMaxKeys()
+	} else if opts.MaxKeys > 0 {
+		err = conn.setMaxKeys(opts.MaxKeys)
 	}
 	return
 }
@@ -187,20 +326,44 @@ const openConnFlags = 0 |
 	sqlite.OpenURI |
 	sqlite.OpenNoMutex
 
+// The flags used for read-only conns. The database must already exist.
+const openReadOnlyConnFlags = 0 |
+	sqlite.OpenReadOnly |
+	sqlite.OpenURI |
+	sqlite.OpenNoMutex
+
 func newSqliteConn(opts NewConnOpts) (sqliteConn, error) {
-	uri := newOpenUri(opts)
+	uri, err := newOpenUri(opts)
+	if err != nil {
+		return nil, err
+	}
+	flags := openConnFlags
+	if opts.readOnly() {
+		flags = openReadOnlyConnFlags
+		if !opts.inMemory() && opts.Path != "" {
+			// sqlite's error for this is just "unable to open database file".
+			if _, err := os.Stat(opts.Path); err != nil {
+				return nil, fmt.Errorf("opening database read-only: %w", err)
+			}
+		}
+	}
 	//log.Printf("opening sqlite conn with uri %q", uri)
-	return sqlite.OpenConn(uri, openConnFlags)
-}
-
-func (conn conn) getValueIdForKey(key string) (ret rowid, err error) {
-	keyCols, err := conn.openKey(key)
-	ret = keyCols.id
-	return
+	conn, err := sqlite.OpenConn(uri, flags)
+	if err != nil && opts.VFS != "" {
+		// There's no way to look up VFSes through the adapter, and sqlite's error for a missing one
+		// doesn't mention it.
+		err = fmt.Errorf("opening with vfs %q: %w", opts.VFS, err)
+	}
+	return conn, err
 }
 
+// Statements are prepared once per conn and reused (see sqlite.Conn.Prepare), so query should be a
+// constant, or come from a small set. Use sqliteExecTransient otherwise.
 func (conn conn) sqliteQuery(query string, result func(stmt *sqlite.Stmt) error, args ...any) error {
-	return sqlitex.Exec(conn.sqliteConn, query, result, args...)
+	if conn.transientStatements {
+		return sqlitex.ExecTransient(conn.sqliteConn, conn.prefixTableNames(query), result, args...)
+	}
+	return sqlitex.Exec(conn.sqliteConn, conn.prefixTableNames(query), result, args...)
 }
 
 // Wraps sqliteQueryRow, without returning the ok bool.
@@ -268,7 +431,7 @@ func (conn conn) getValueLength(key string) (length int64, err error) {
 }
 
 func (conn conn) openBlob(blobId rowid, write bool) (*sqlite.Blob, error) {
-	return openSqliteBlob(conn.sqliteConn, blobId, write)
+	return openSqliteBlob(conn.sqliteConn, conn.tablePrefix+"blobs", blobId, write)
 }
 
 // This is a wrapper to trim and tidy the sql from the source if needed. It's also easier to format
@@ -301,6 +464,10 @@ func (conn conn) iterBlobs(
 	// but keep the statement running.
 	more := true
 	for it.Valid() && it.Cur().keyId == valueId {
+		if it.Cur().offset > startOffset {
+			// There's a gap in the cached blobs, which might not be a gap in the value.
+			break
+		}
 		blobEnd := it.Cur().offset + it.Value().Size()
 		if blobEnd > startOffset {
 			more, err = iter(it.Cur().offset, it.Value())
@@ -312,13 +479,22 @@ func (conn conn) iterBlobs(
 		}
 		it.Next()
 	}
-	err = conn.sqliteQuery(
-		sqlQuery(`
-			select offset, blob_id 
-			from "values" join blobs using (blob_id) 
+	query := sqlQuery(`
+		select offset, blob_id, null
+		from "values" join blobs using (blob_id)
+		where value_id=? and offset+length(blob) > ?
+		order by offset`,
+	)
+	if conn.verifyChecksums {
+		query = sqlQuery(`
+			select offset, blob_id, checksum
+			from "values" join blobs using (blob_id) left join blob_checksums using (blob_id)
 			where value_id=? and offset+length(blob) > ?
 			order by offset`,
-		),
+		)
+	}
+	err = conn.sqliteQuery(
+		query,
 		func(stmt *sqlite.Stmt) (err error) {
 			if !more {
 				return
@@ -333,6 +509,13 @@ func (conn conn) iterBlobs(
 			blob, ok := conn.blobs.Get(key)
 			if !ok {
 				blob, err = conn.openBlob(blobId, write)
+				if err == nil && stmt.ColumnType(2) != sqlite.TypeNull {
+					err = conn.verifyBlobChecksum(valueId, offset, blob, uint32(stmt.ColumnInt64(2)))
+					if err != nil {
+						blob.Close()
+						return
+					}
+				}
 				if err == nil {
 					_, oldBlob, replaced := conn.blobs.Upsert(key, blob)
 					if replaced {
@@ -356,30 +539,70 @@ func (conn conn) iterBlobs(
 	return
 }
 
+// Expired keys are not found, and are deleted after the transaction.
 func (conn conn) openKey(key string) (ret keyCols, err error) {
+	ret, expired, err := conn.openKeyIncludingExpired(key)
+	if err == nil && expired {
+		conn.expiredKeys = append(conn.expiredKeys, ret.id)
+		err = ErrNotFound
+	}
+	return
+}
+
+func (conn conn) openKeyIncludingExpired(key string) (ret keyCols, expired bool, err error) {
+	return conn.openKeyWhere("key=?", key)
+}
+
+// Opens the key matching where, a condition on the keys table.
+func (conn conn) openKeyWhere(where string, args ...any) (ret keyCols, expired bool, err error) {
+	var contentId rowid
 	ok, err := conn.sqliteQueryRow(
-		`select key_id, length from keys where key=?`,
+		`
+			select
+				key_id, length,
+				coalesce(expires <= `+nowMillisSql+`, false),
+				coalesce(compression, 0), coalesce(uncompressed_length, length),
+				key_encryption.key_id is not null,
+				coalesce(content_key_id, 0)
+			from keys
+			left join key_expiries using (key_id)
+			left join key_compression using (key_id)
+			left join key_encryption using (key_id)
+			left join key_dedup using (key_id)
+			where `+where,
 		func(stmt *sqlite.Stmt) error {
 			ret.id = stmt.ColumnInt64(0)
 			ret.length = stmt.ColumnInt64(1)
+			expired = stmt.ColumnInt(2) != 0
+			ret.compression = Compression(stmt.ColumnInt(3))
+			ret.uncompressedLength = stmt.ColumnInt64(4)
+			ret.encrypted = stmt.ColumnInt(5) != 0
+			contentId = stmt.ColumnInt64(6)
 			return nil
 		},
-		key,
+		append([]any{conn.nowArg()}, args...)...,
 	)
 	if err != nil {
 		return
 	}
 	if !ok {
 		err = ErrNotFound
+		return
+	}
+	if contentId != 0 {
+		var content keyCols
+		content, _, err = conn.openKeyWhere("key_id=?", contentId)
+		ret.deduped = &content
 	}
 	return
 }
 
-func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, err error) {
-	cols, err := conn.openKey(key)
+// Returns the existing key if it can be reused for create, otherwise creates it.
+func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, created bool, err error) {
+	cols, expired, err := conn.openKeyIncludingExpired(key)
 	switch {
 	case err == nil:
-		if cols.length == create.Length {
+		if cols.length == create.Length && !expired && cols.checkPinnable() == nil {
 			keyId = cols.id
 			return
 		}
@@ -393,56 +616,117 @@ func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, err erro
 		return
 	}
 	err = conn.sqliteQueryMustOneRow(
-		`insert into keys (key, length) values (?, ?) returning key_id`,
+		`insert into keys (key, length, create_time, last_used)
+		values (?, ?, `+nowMillisSql+`, `+nowMillisSql+`) returning key_id`,
 		func(stmt *sqlite.Stmt) error {
 			keyId = stmt.ColumnInt64(0)
 			return nil
 		},
 		key,
 		create.Length,
+		conn.nowArg(),
+		conn.nowArg(),
 	)
 	if err != nil {
 		return
 	}
-	for off := int64(0); off < create.Length; off += conn.maxBlobSize {
-		blobSize := create.Length - off
-		if blobSize > conn.maxBlobSize {
-			blobSize = conn.maxBlobSize
-		}
-		err = conn.sqliteExec(
-			`insert into blobs (blob) values (zeroblob(?))`,
-			blobSize,
-		)
+	created = true
+	err = conn.storeKeyCost(keyId)
+	if err != nil {
+		return
+	}
+	if create.Sparse {
+		return
+	}
+	err = conn.allocateBlobs(keyId, 0, create.Length)
+	return
+}
+
+// Inserts zeroed blobs covering [start, end) of a value, split at multiples of maxBlobSize.
+func (conn conn) allocateBlobs(valueId rowid, start, end int64) (err error) {
+	for off := start; off < end; {
+		blobEnd := g.Min(end, (off/conn.maxBlobSize+1)*conn.maxBlobSize)
+		err = conn.insertBlob(valueId, off, blobEnd-off)
 		if err != nil {
 			return
 		}
-		blobId := conn.sqliteConn.LastInsertRowID()
-		err = conn.sqliteExec(
-			`insert into "values" (value_id, offset, blob_id) values (?, ?, ?)`,
-			keyId, off, blobId,
-		)
-		if err != nil {
-			panic(err)
-		}
+		off = blobEnd
+	}
+	return
+}
+
+func (conn conn) insertBlob(valueId rowid, offset, size int64) (err error) {
+	err = conn.sqliteExec(
+		`insert into blobs (blob) values (zeroblob(?))`,
+		size,
+	)
+	if err != nil {
+		return
+	}
+	blobId := conn.sqliteConn.LastInsertRowID()
+	err = conn.sqliteExec(
+		`insert into "values" (value_id, offset, blob_id) values (?, ?, ?)`,
+		valueId, offset, blobId,
+	)
+	if err != nil {
+		panic(err)
 	}
 	return
 }
 
 const defaultMaxBlobSize int64 = 1 << 20
 
+// SQLITE_LIMIT_LENGTH, which isn't exposed by the adapter.
+const sqliteLimitLength = 0
+
+// Values written with a different max blob size are still read correctly, as blobs are found by
+// their offset.
+func (conn conn) checkMaxBlobSize() error {
+	if conn.maxBlobSize <= 0 {
+		return fmt.Errorf("max blob size %v must be positive", conn.maxBlobSize)
+	}
+	limit := conn.sqliteConn.Limit(sqliteLimitLength, -1)
+	if conn.maxBlobSize > int64(limit) {
+		return fmt.Errorf("max blob size %v exceeds sqlite length limit %v", conn.maxBlobSize, limit)
+	}
+	return nil
+}
+
 func (conn conn) sqliteExec(query string, args ...any) error {
 	return conn.sqliteQuery(query, nil, args...)
 }
 
+// Executes a query that isn't worth keeping prepared, like one with values formatted into it.
+func (conn conn) sqliteExecTransient(query string, args ...any) error {
+	return sqlitex.ExecTransient(conn.sqliteConn, conn.prefixTableNames(query), nil, args...)
+}
+
+// The current time in milliseconds since the Unix epoch, with a parameter for nowArg.
+const nowMillisSql = "coalesce(?, cast(unixepoch('subsec')*1e3 as integer))"
+
+// The argument for a nowMillisSql parameter. It's NULL unless there's a time source, so SQLite's
+// clock is used.
+func (conn conn) nowArg() any {
+	if conn.timeSource == nil {
+		return nil
+	}
+	return conn.timeSource()
+}
+
 func (conn conn) accessedKey(keyId rowid, ignoreBusy bool) (ignored bool, err error) {
+	if conn.readOnly {
+		ignored = true
+		return
+	}
 	err = conn.sqliteExec(
 		sqlQuery(`
 			update keys
 			set 
-				last_used=cast(unixepoch('subsec')*1e3 as integer),
+				last_used=`+nowMillisSql+`,
 				access_count=access_count+1
 			where key_id=?`,
 		),
+		conn.nowArg(),
 		keyId,
 	)
 	if ignoreBusy && sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeBusy) {
@@ -452,6 +736,25 @@ func (conn conn) accessedKey(keyId rowid, ignoreBusy bool) (ignored bool, err er
 	return
 }
 
+// Returns whether table has any rows. The answer is kept in cached for the rest of the
+// transaction, so writers should set it when they insert.
+func (conn conn) tableHasRows(table string, cached *g.Option[bool]) (has bool, err error) {
+	if cached.Ok {
+		return cached.Value, nil
+	}
+	err = conn.sqliteQueryMustOneRow(
+		"select exists (select 1 from "+table+")",
+		func(stmt *sqlite.Stmt) error {
+			has = stmt.ColumnInt(0) != 0
+			return nil
+		},
+	)
+	if err == nil {
+		cached.Set(has)
+	}
+	return
+}
+
 func (conn conn) closeBlobs() {
 	it := conn.blobs.Iterator()
 	it.First()
@@ -480,64 +783,104 @@ func (conn conn) forgetBlobsForKeyId(keyId rowid) (err error) {
 
 const logTrimmedKeys = true
 
-func (conn conn) trimToCapacity(eachKey func(keyId rowid)) (err error) {
+type evictedKey struct {
+	key string
+	// Set for indexed values.
+	index  g.Option[uint64]
+	length int64
+}
+
+// Deletes keys in eviction order until the database is within its limits. freed is the total
+// length of the deleted values. Indexed values are only deleted to get under capacity, as they don't
+// count toward the limit on keys.
+func (conn conn) trimToCapacity() (evicted int, freed int64, err error) {
+	if conn.readOnly {
+		return
+	}
 	capacity, err := conn.getCapacity()
 	if err != nil {
 		return
 	}
-	if !capacity.Ok {
+	maxKeys, err := conn.getMaxKeys()
+	if err != nil {
+		return
+	}
+	if !capacity.Ok && !maxKeys.Ok {
 		return
 	}
 	for {
-		var bytesUsed int64
-		bytesUsed, err = conn.bytesUsed()
+		started := time.Now()
+		var overBytes, overKeys bool
+		overBytes, overKeys, err = conn.overCapacity(capacity, maxKeys)
 		if err != nil {
 			return
 		}
-		if bytesUsed <= capacity.Value {
+		if !overBytes && !overKeys {
 			return
 		}
+		victimWhere := "key_id not in (select key_id from dedup_contents)"
+		if !overBytes {
+			victimWhere += " and keys.key is not null"
+		}
 		var (
-			key         string
+			e           evictedKey
 			lastUsed    time.Time
 			accessCount int64
 			createTime  time.Time
-			length      int64
 			keyId       int64
 		)
 		ok, err := conn.sqliteQueryRow(
-			sqlQuery(`
-				delete from keys
-				where key_id=(select key_id from keys order by last_used, access_count, create_time limit 1)
-				returning key, last_used, access_count, create_time, length, key_id
-			`),
+			fmt.Sprintf(`
+				select key_id, coalesce(keys.key, key_indices.key), idx, last_used, access_count, create_time, length
+				from keys left join key_indices using (key_id)
+				where %v
+				order by %v limit 1
+			`, victimWhere, conn.evictionPolicy.orderBy()),
 			func(stmt *sqlite.Stmt) error {
+				keyId = stmt.ColumnInt64(0)
+				e.key = stmt.ColumnText(1)
+				if stmt.ColumnType(2) != sqlite.TypeNull {
+					e.index.Set(uint64(stmt.ColumnInt64(2)))
+				}
 				if logTrimmedKeys {
-					key = stmt.ColumnText(0)
-					lastUsed = timeFromStmtColumn(stmt, 1)
-					accessCount = stmt.ColumnInt64(2)
-					createTime = timeFromStmtColumn(stmt, 3)
-					length = stmt.ColumnInt64(4)
+					lastUsed = timeFromStmtColumn(stmt, 3)
+					accessCount = stmt.ColumnInt64(4)
+					createTime = timeFromStmtColumn(stmt, 5)
 				}
-				keyId = stmt.ColumnInt64(5)
+				e.length = stmt.ColumnInt64(6)
 				return nil
 			},
 		)
 		if err != nil {
-			return err
+			return evicted, freed, err
 		}
 		if !ok {
-			return errors.New("couldn't find keys to delete")
+			return evicted, freed, errors.New("couldn't find keys to delete")
+		}
+		err = conn.sqliteExec("delete from keys where key_id=?", keyId)
+		if err != nil {
+			return evicted, freed, err
 		}
-		if eachKey != nil {
-			eachKey(keyId)
+		evicted++
+		freed += e.length
+		err = conn.forgetBlobsForKeyId(keyId)
+		if err != nil {
+			return evicted, freed, err
+		}
+		if conn.collectEvicted {
+			conn.evictedKeys = append(conn.evictedKeys, e)
 		}
+		conn.slowLog.check("evict", e.key, started)
 		if logTrimmedKeys {
+			name := fmt.Sprintf("key %q", e.key)
+			if e.index.Ok {
+				name += fmt.Sprintf(" index %v", e.index.Value)
+			}
 			conn.logger.Levelf(
 				log.Debug,
-				"trimmed key %q (size %v, last used %v ago, access count %v, created %v ago)",
-				key,
-				length,
+				"trimmed %v (size %v, last used %v ago, access count %v, created %v ago)",
+				name,
+				e.length,
 				time.Since(lastUsed).Truncate(time.Second),
 				accessCount,
 				time.Since(createTime).Truncate(time.Second),
@@ -571,13 +914,62 @@ func (conn conn) execPragmaReturningInt64(pragma string) (ret int64, err error)
 	return
 }
 
+func (conn conn) execPragmaReturningText(pragma string) (ret string, err error) {
+	err = conn.sqliteQueryMustOneRow(fmt.Sprintf("pragma %v", pragma), func(stmt *sqlite.Stmt) error {
+		ret = stmt.ColumnText(0)
+		return nil
+	})
+	return
+}
+
+// Whether bytes used, and the number of keys, exceed their limits. Indexed values and content
+// values for deduplication aren't keys.
+func (conn conn) overCapacity(capacity, maxKeys g.Option[int64]) (overBytes, overKeys bool, err error) {
+	if capacity.Ok {
+		var used int64
+		if conn.costFunc != nil {
+			used, err = conn.totalCost()
+		} else {
+			used, err = conn.bytesUsed()
+		}
+		if err != nil {
+			return
+		}
+		overBytes = used > capacity.Value
+	}
+	if maxKeys.Ok {
+		var keys int64
+		err = conn.sqliteQueryMustOneRow(
+			"select count(*) from keys where key is not null",
+			func(stmt *sqlite.Stmt) error {
+				keys = stmt.ColumnInt64(0)
+				return nil
+			},
+		)
+		if err != nil {
+			return
+		}
+		overKeys = keys > maxKeys.Value
+	}
+	return
+}
+
 func (conn conn) getCapacity() (capacity g.Option[int64], err error) {
+	return conn.getIntSetting("capacity")
+}
+
+func (conn conn) getMaxKeys() (maxKeys g.Option[int64], err error) {
+	return conn.getIntSetting("max_keys")
+}
+
+func (conn conn) getIntSetting(name string) (value g.Option[int64], err error) {
 	err = conn.sqliteQueryMaxOneRow(
-		"select value from setting where name='capacity'",
+		"select value from setting where name=?",
 		func(stmt *sqlite.Stmt) error {
-			capacity.Set(stmt.ColumnInt64(0))
+			value.Set(stmt.ColumnInt64(0))
 			return nil
 		},
+		name,
 	)
 	return
 }
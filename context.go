@@ -0,0 +1,65 @@
+package squirrel
+
+import (
+	"context"
+	"time"
+)
+
+// Like Tx, but the transaction is interrupted and rolled back if ctx is done, in which case
+// ctx.Err() is returned.
+func (c *Cache) TxContext(ctx context.Context, f func(tx *Tx) error) (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.runTxContext(ctx, f, "")
+}
+
+// Like TxImmediate, but the transaction is interrupted and rolled back if ctx is done, in which
+// case ctx.Err() is returned.
+func (c *Cache) TxImmediateContext(ctx context.Context, f func(tx *Tx) error) (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.runTxContext(ctx, f, "immediate")
+}
+
+// Like Put, but gives up and leaves any existing value in place if ctx is done.
+func (c *Cache) PutContext(ctx context.Context, name string, b []byte) (err error) {
+	defer c.opts.slowLogger().check("put", name, time.Now())
+	defer func() { c.observePut(name, len(b), err) }()
+	if c.opts.WriteBehind.Ok {
+		return c.putWriteBehind(name, b)
+	}
+	return c.runTxContext(ctx, func(tx *Tx) error {
+		return tx.Put(name, b)
+	}, "immediate")
+}
+
+// Like ReadFull, but gives up if ctx is done.
+func (c *Cache) ReadFullContext(ctx context.Context, key string, b []byte) (n int, err error) {
+	defer c.opts.slowLogger().check("read full", key, time.Now())
+	defer func() { c.observeRead(key, err) }()
+	if value, ok := c.writeBehind.get(key); ok {
+		return readFullFromBuffer(key, value, b)
+	}
+	err = c.runTxContext(ctx, func(tx *Tx) error {
+		n, err = tx.ReadFull(key, b)
+		return err
+	}, "")
+	return
+}
+
+// Like ReadAll, but gives up if ctx is done.
+func (c *Cache) ReadAllContext(ctx context.Context, key string, b []byte) (ret []byte, err error) {
+	defer func() { c.observeRead(key, err) }()
+	if value, ok := c.writeBehind.get(key); ok {
+		return append(b[:0], value...), nil
+	}
+	err = c.runTxContext(ctx, func(tx *Tx) error {
+		ret, err = tx.ReadAll(key, b)
+		return err
+	}, "")
+	return
+}
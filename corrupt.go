@@ -0,0 +1,72 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/anacrolix/log"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Primary result codes from sqlite3 that aren't exposed by the adapter.
+const (
+	resultCodeCorrupt = sqlite.ResultCode(11) // SQLITE_CORRUPT
+	resultCodeNotADb  = sqlite.ResultCode(26) // SQLITE_NOTADB
+)
+
+// Returned by NewCache when the database file is corrupt or isn't a database.
+type ErrCorruptDatabase struct {
+	Path string
+	Err  error
+}
+
+func (e ErrCorruptDatabase) Error() string {
+	return fmt.Sprintf("corrupt database %q: %v", e.Path, e.Err)
+}
+
+func (e ErrCorruptDatabase) Unwrap() error {
+	return e.Err
+}
+
+func isCorruptErr(err error) bool {
+	return sqlite.IsPrimaryResultCodeErr(err, resultCodeCorrupt) ||
+		sqlite.IsPrimaryResultCodeErr(err, resultCodeNotADb)
+}
+
+// Removes the database file at path and the files sqlite keeps alongside it.
+func removeDatabaseFiles(path string) (err error) {
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		removeErr := os.Remove(path + suffix)
+		if !errors.Is(removeErr, fs.ErrNotExist) {
+			err = errors.Join(err, removeErr)
+		}
+	}
+	return
+}
+
+// Opens the first conn for a new Cache, recreating the database if it's corrupt and that's
+// permitted.
+func (cl *Cache) newFirstConn() (conn conn, err error) {
+	conn, err = cl.newConn()
+	if !isCorruptErr(err) {
+		return
+	}
+	opts := cl.opts
+	if opts.RecreateOnCorrupt && !opts.inMemory() && opts.Path != "" && !opts.readOnly() {
+		opts.Logger.Levelf(log.Warning, "recreating corrupt database %q: %v", opts.Path, err)
+		err = removeDatabaseFiles(opts.Path)
+		if err != nil {
+			return nil, fmt.Errorf("removing corrupt database: %w", err)
+		}
+		conn, err = cl.newConn()
+		if !isCorruptErr(err) {
+			return
+		}
+	}
+	return nil, ErrCorruptDatabase{
+		Path: opts.Path,
+		Err:  err,
+	}
+}
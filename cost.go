@@ -0,0 +1,48 @@
+package squirrel
+
+import (
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Returns the amount a value contributes toward the capacity of the Cache.
+type CostFunc func(key string, length int64) int64
+
+// Stores the cost of the key if there's a CostFunc. Must be called whenever the length changes.
+func (conn conn) storeKeyCost(keyId rowid) (err error) {
+	if conn.costFunc == nil {
+		return
+	}
+	var (
+		key    string
+		length int64
+	)
+	err = conn.sqliteQueryMustOneRow(
+		"select key, length from keys where key_id=?",
+		func(stmt *sqlite.Stmt) error {
+			key = stmt.ColumnText(0)
+			length = stmt.ColumnInt64(1)
+			return nil
+		},
+		keyId,
+	)
+	if err != nil {
+		return
+	}
+	return conn.sqliteExec(
+		"insert or replace into key_costs (key_id, cost) values (?, ?)",
+		keyId,
+		conn.costFunc(key, length),
+	)
+}
+
+// Sums the stored costs of all keys. Keys created without a CostFunc cost their length.
+func (conn conn) totalCost() (ret int64, err error) {
+	err = conn.sqliteQueryMustOneRow(
+		"select coalesce(sum(coalesce(cost, length)), 0) from keys left join key_costs using (key_id)",
+		func(stmt *sqlite.Stmt) error {
+			ret = stmt.ColumnInt64(0)
+			return nil
+		},
+	)
+	return
+}
@@ -0,0 +1,112 @@
+package squirrel
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// With NewCacheOpts.Dedup, values written with Put are stored once per distinct content, in a
+// content value without a key that's shared by every key with that content. Content values aren't
+// evicted themselves: they're deleted with the last key referring to them. Deduplicated values
+// can't be modified in place.
+
+// Returned when opening a deduplicated value as a PinnedBlob, or modifying it in place.
+var ErrDeduplicated = errors.New("value is deduplicated")
+
+func (tx *Tx) putDeduped(name string, b []byte) (err error) {
+	conn := tx.conn
+	hash := sha256.Sum256(b)
+	var contentId rowid
+	found, err := conn.sqliteQueryRow(
+		`select key_id from dedup_contents where hash=?`,
+		func(stmt *sqlite.Stmt) error {
+			contentId = stmt.ColumnInt64(0)
+			return nil
+		},
+		hash[:],
+	)
+	if err != nil {
+		return
+	}
+	if !found {
+		contentId, err = tx.putDedupContent(hash[:], b)
+		if err != nil {
+			return
+		}
+	}
+	var keyId rowid
+	err = conn.sqliteQueryMustOneRow(
+		`insert into keys (key, length, create_time, last_used)
+		values (?, ?, `+nowMillisSql+`, `+nowMillisSql+`) returning key_id`,
+		func(stmt *sqlite.Stmt) error {
+			keyId = stmt.ColumnInt64(0)
+			return nil
+		},
+		name, len(b), conn.nowArg(), conn.nowArg(),
+	)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(`insert into key_dedup (key_id, content_key_id) values (?, ?)`, keyId, contentId)
+	if err != nil {
+		return
+	}
+	return conn.storeKeyCost(keyId)
+}
+
+// Stores b, compressed if configured, as a new content value.
+func (tx *Tx) putDedupContent(hash, b []byte) (contentId rowid, err error) {
+	conn := tx.conn
+	stored, compression, err := conn.compressValue(b)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteQueryMustOneRow(
+		`insert into keys (length, create_time, last_used)
+		values (?, `+nowMillisSql+`, `+nowMillisSql+`) returning key_id`,
+		func(stmt *sqlite.Stmt) error {
+			contentId = stmt.ColumnInt64(0)
+			return nil
+		},
+		len(stored), conn.nowArg(), conn.nowArg(),
+	)
+	if err != nil {
+		return
+	}
+	// The key_id could belong to a content value deleted earlier in the transaction.
+	err = conn.forgetBlobsForKeyId(contentId)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(`insert into dedup_contents (key_id, hash) values (?, ?)`, contentId, hash)
+	if err != nil {
+		return
+	}
+	err = conn.storeKeyCompression(contentId, compression, int64(len(b)))
+	if err != nil {
+		return
+	}
+	err = conn.allocateBlobs(contentId, 0, int64(len(stored)))
+	if err != nil {
+		return
+	}
+	_, err = conn.valueIoAt(contentId, int64(len(stored)), stored, 0, true)
+	return
+}
+
+// Returns the number of distinct content values, and the number of keys referring to them.
+func (c *Cache) DedupStats() (uniqueContents, totalRefs int64, err error) {
+	err = c.withConn(func(c conn) error {
+		return c.sqliteQueryMustOneRow(
+			`select (select count(*) from dedup_contents), (select count(*) from key_dedup)`,
+			func(stmt *sqlite.Stmt) error {
+				uniqueContents = stmt.ColumnInt64(0)
+				totalRefs = stmt.ColumnInt64(1)
+				return nil
+			},
+		)
+	})
+	return
+}
@@ -0,0 +1,29 @@
+package squirrel
+
+// Deletes each of keys that exists, returning the number deleted.
+func (tx *Tx) DeleteMulti(keys []string) (deleted int, err error) {
+	for _, key := range keys {
+		err = tx.Delete(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		deleted++
+	}
+	err = nil
+	return
+}
+
+// Deletes keys in a single transaction, returning the number that existed and were deleted.
+func (c *Cache) DeleteMulti(keys []string) (deleted int, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		deleted, err = tx.DeleteMulti(keys)
+		return
+	})
+	if err != nil {
+		deleted = 0
+	}
+	return
+}
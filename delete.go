@@ -0,0 +1,100 @@
+package squirrel
+
+import (
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Deletes the value for key. Deleting a key that doesn't exist does nothing.
+func (c *Cache) Delete(key string) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		err := tx.Delete(key)
+		if err == ErrNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+// Deletes all keys that start with prefix, returning how many there were.
+func (c *Cache) DeletePrefix(prefix string) (deleted int, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		deleted, err = tx.DeletePrefix(prefix)
+		return
+	})
+	if err != nil {
+		deleted = 0
+	}
+	return
+}
+
+func (tx *Tx) DeletePrefix(prefix string) (deleted int, err error) {
+	var keyIds []rowid
+	onRow := func(stmt *sqlite.Stmt) error {
+		keyIds = append(keyIds, stmt.ColumnInt64(0))
+		return nil
+	}
+	if upper, ok := prefixUpperBound(prefix); ok {
+		err = tx.conn.sqliteQuery("delete from keys where key >= ? and key < ? returning key_id", onRow, prefix, upper)
+	} else {
+		err = tx.conn.sqliteQuery("delete from keys where key >= ? returning key_id", onRow, prefix)
+	}
+	if err != nil {
+		return
+	}
+	for _, keyId := range keyIds {
+		err = tx.conn.forgetBlobsForKeyId(keyId)
+		if err != nil {
+			return
+		}
+	}
+	deleted = len(keyIds)
+	return
+}
+
+// Deletes all keys, keeping settings such as capacity. Values buffered for write-behind are
+// flushed first, so they don't reappear. Free pages are then returned to the filesystem if
+// auto_vacuum is incremental.
+func (c *Cache) Clear() (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	err = c.TxImmediate(func(tx *Tx) error {
+		return tx.Clear()
+	})
+	if err != nil {
+		return
+	}
+	return c.IncrementalVacuum(0)
+}
+
+// Tables are emptied before those they reference, so there's nothing to cascade.
+var clearTables = []string{
+	"blob_checksums",
+	"blob_hashes",
+	"blobs",
+	`"values"`,
+	"tags",
+	"key_costs",
+	"key_expiries",
+	"key_compression",
+	"key_encryption",
+	"key_indices",
+	"key_written_ranges",
+	"json_values",
+	"key_dedup",
+	"dedup_contents",
+	"keys",
+}
+
+// Deletes all keys.
+func (tx *Tx) Clear() (err error) {
+	tx.conn.closeBlobs()
+	for _, table := range clearTables {
+		err = tx.conn.sqliteExec("delete from " + table)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
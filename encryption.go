@@ -0,0 +1,86 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Encrypts values at rest. Values written with Put are split into blobs of at most
+// NewConnOpts.MaxBlobSize, and each blob is encrypted separately, so Decrypt is given exactly what
+// Encrypt returned for a blob. The ciphertext may be longer than the plaintext. Capacity is
+// measured from the database, so it applies to the ciphertext. Values written in place through
+// PinnedBlobs, NewWriter or AppendFrame are not encrypted.
+type BlobCrypter interface {
+	Encrypt(plain []byte) []byte
+	Decrypt(cipher []byte) ([]byte, error)
+}
+
+// Returned when opening an encrypted value as a PinnedBlob, or modifying it in place.
+var ErrEncrypted = errors.New("value is encrypted")
+
+func (conn conn) putEncrypted(key string, b []byte) (keyId rowid, err error) {
+	// The blobs are inserted here, with their encrypted lengths.
+	keyId, _, err = conn.createKey(key, CreateOpts{Length: int64(len(b)), Sparse: true})
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec("insert into key_encryption (key_id) values (?)", keyId)
+	if err != nil {
+		return
+	}
+	for off := int64(0); off < int64(len(b)); {
+		end := g.Min(int64(len(b)), off+conn.maxBlobSize)
+		err = conn.sqliteExec(`insert into blobs (blob) values (?)`, conn.blobCrypter.Encrypt(b[off:end]))
+		if err != nil {
+			return
+		}
+		err = conn.sqliteExec(
+			`insert into "values" (value_id, offset, blob_id) values (?, ?, ?)`,
+			keyId, off, conn.sqliteConn.LastInsertRowID(),
+		)
+		if err != nil {
+			return
+		}
+		off = end
+	}
+	return
+}
+
+// Returns the stored bytes of the value, decrypting them if necessary.
+func (conn conn) readStored(key keyCols) (b []byte, err error) {
+	b = make([]byte, key.length)
+	if !key.encrypted {
+		_, err = conn.valueIoAt(key.id, key.length, b, 0, false)
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	if conn.blobCrypter == nil {
+		err = errors.New("value is encrypted and no BlobCrypter is set")
+		return
+	}
+	err = conn.sqliteQuery(
+		`select offset, blob from "values" join blobs using (blob_id) where value_id=? order by offset`,
+		func(stmt *sqlite.Stmt) error {
+			off := stmt.ColumnInt64(0)
+			cipher := make([]byte, stmt.ColumnLen(1))
+			stmt.ColumnBytes(1, cipher)
+			plain, err := conn.blobCrypter.Decrypt(cipher)
+			if err != nil {
+				return fmt.Errorf("decrypting blob at offset %v: %w", off, err)
+			}
+			if off+int64(len(plain)) > key.length {
+				return fmt.Errorf("decrypted blob at offset %v overruns value", off)
+			}
+			copy(b[off:], plain)
+			return nil
+		},
+		key.id,
+	)
+	return
+}
@@ -1,6 +1,9 @@
 package squirrel
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 )
 
@@ -19,3 +22,36 @@ func (e errNotFound) Is(target error) bool {
 }
 
 var ErrNotFound = errNotFound{}
+
+// Returned when reading a region of a sparse value that hasn't been written, if
+// NewCacheOpts.SparseReadsErr is set.
+var ErrNotPresent = errors.New("not present")
+
+// Returned by ReadMapped when mmap isn't enabled, or the value isn't stored in a single blob.
+var ErrNotMappable = errors.New("not mappable")
+
+// Returned by ReadFull when the value is shorter than the buffer. It wraps io.ErrUnexpectedEOF.
+type ErrShortValue struct {
+	Key string
+	// The length of the value.
+	Have int64
+	// The length of the buffer.
+	Want int64
+}
+
+func (e ErrShortValue) Error() string {
+	return fmt.Sprintf("value for %q has length %v, wanted %v", e.Key, e.Have, e.Want)
+}
+
+func (e ErrShortValue) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// Returned when a key can't be created because it already exists.
+type ErrKeyExists struct {
+	Key string
+}
+
+func (e ErrKeyExists) Error() string {
+	return fmt.Sprintf("key %q already exists", e.Key)
+}
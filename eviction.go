@@ -0,0 +1,39 @@
+package squirrel
+
+import (
+	"fmt"
+)
+
+// Determines which keys are deleted first when trimming to capacity.
+type EvictionPolicy int
+
+const (
+	// Evict the least recently used keys first.
+	EvictLRU EvictionPolicy = iota
+	// Evict the least frequently used keys first. Ties are broken by least recent use.
+	EvictLFU
+)
+
+// Returns the ordering of keys for eviction, in the same form as the columns of indexes supporting
+// it.
+func (policy EvictionPolicy) orderBy() string {
+	switch policy {
+	case EvictLRU:
+		return "last_used, access_count, create_time"
+	case EvictLFU:
+		return "access_count, last_used, create_time"
+	default:
+		panic(policy)
+	}
+}
+
+// Creates the index needed to evict efficiently under policy, if it's not in the base schema.
+func (conn conn) initEvictionIndex(policy EvictionPolicy) error {
+	if policy != EvictLFU {
+		return nil
+	}
+	return conn.sqliteExec(fmt.Sprintf(
+		"create index if not exists key_access_count on keys(%v, key_id)",
+		policy.orderBy(),
+	))
+}
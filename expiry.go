@@ -0,0 +1,95 @@
+package squirrel
+
+import (
+	"time"
+
+	"github.com/anacrolix/log"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Puts the value for key, which expires after ttl. Expired keys aren't found, and are deleted
+// when they're next opened, or by EvictExpired.
+func (c *Cache) PutWithTTL(key string, b []byte, ttl time.Duration) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.PutWithTTL(key, b, ttl)
+	})
+}
+
+func (tx *Tx) PutWithTTL(key string, b []byte, ttl time.Duration) (err error) {
+	err = tx.Put(key, b)
+	if err != nil {
+		return
+	}
+	return tx.conn.sqliteExec(
+		`
+			insert or replace into key_expiries (key_id, expires)
+			select key_id, `+nowMillisSql+`+? from keys where key=?`,
+		tx.conn.nowArg(),
+		ttl.Milliseconds(),
+		key,
+	)
+}
+
+// Deletes all expired keys, returning how many there were.
+func (c *Cache) EvictExpired() (evicted int, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		var keyIds []rowid
+		err = tx.conn.sqliteQuery(
+			`
+				delete from keys where key_id in (
+					select key_id from key_expiries
+					where expires <= `+nowMillisSql+`
+				)
+				returning key_id`,
+			func(stmt *sqlite.Stmt) error {
+				keyIds = append(keyIds, stmt.ColumnInt64(0))
+				return nil
+			},
+			tx.conn.nowArg(),
+		)
+		if err != nil {
+			return
+		}
+		for _, keyId := range keyIds {
+			err = tx.conn.forgetBlobsForKeyId(keyId)
+			if err != nil {
+				return
+			}
+		}
+		evicted = len(keyIds)
+		return
+	})
+	if err != nil {
+		evicted = 0
+	}
+	return
+}
+
+// Deletes keys found to have expired during a transaction, once it has ended. This is best-effort,
+// as it's skipped on read-only conns and the database may be busy. EvictExpired will catch any
+// that remain.
+func (conn conn) deleteExpiredKeys() {
+	keyIds := conn.expiredKeys
+	conn.expiredKeys = nil
+	if conn.readOnly {
+		return
+	}
+	for _, keyId := range keyIds {
+		// The key may have been replaced since it was found.
+		err := conn.sqliteExec(
+			`
+				delete from keys where key_id in (
+					select key_id from key_expiries
+					where key_id=? and expires <= `+nowMillisSql+`
+				)`,
+			keyId,
+			conn.nowArg(),
+		)
+		if err == nil {
+			err = conn.forgetBlobsForKeyId(keyId)
+		}
+		if err != nil {
+			conn.logger.Levelf(log.Debug, "deleting expired key %v: %v", keyId, err)
+		}
+	}
+}
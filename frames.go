@@ -0,0 +1,58 @@
+package squirrel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Appends frame to the value for key, prefixed with its length so it can be recovered with
+// IterFrames. The value is created if it doesn't exist.
+func (c *Cache) AppendFrame(key string, frame []byte) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.AppendFrame(key, frame)
+	})
+}
+
+func (tx *Tx) AppendFrame(key string, frame []byte) (err error) {
+	cols, err := tx.conn.openKey(key)
+	if errors.Is(err, ErrNotFound) {
+		cols.id, _, err = tx.conn.createKey(key, CreateOpts{})
+	}
+	if err != nil {
+		return
+	}
+	err = cols.checkPinnable()
+	if err != nil {
+		return
+	}
+	b := binary.AppendUvarint(nil, uint64(len(frame)))
+	b = append(b, frame...)
+	err = tx.conn.growValue(cols, cols.length+int64(len(b)))
+	if err != nil {
+		return
+	}
+	_, err = tx.conn.valueIoAt(cols.id, cols.length+int64(len(b)), b, cols.length, true)
+	return
+}
+
+// Calls f with each frame appended to the value for key with AppendFrame, in order.
+func (c *Cache) IterFrames(key string, f func(frame []byte) error) error {
+	b, err := c.ReadAll(key, nil)
+	if err != nil {
+		return err
+	}
+	for off := 0; off < len(b); {
+		frameLen, n := binary.Uvarint(b[off:])
+		if n <= 0 || uint64(len(b)-off-n) < frameLen {
+			return fmt.Errorf("malformed frame at offset %v", off)
+		}
+		off += n
+		err = f(b[off : off+int(frameLen)])
+		if err != nil {
+			return err
+		}
+		off += int(frameLen)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Returns a read-only view of the Cache where keys are file paths. Directories are implied by "/"
+// in keys, and exist while there are keys under them. Keys that aren't valid paths (see
+// fs.ValidPath) can't be opened. Files are read with NewReader, so each holds a read transaction
+// open until it's closed.
+func (c *Cache) FS() fs.FS {
+	return cacheFS{c}
+}
+
+type cacheFS struct {
+	c *Cache
+}
+
+func (fsys cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	// So values buffered by write-behind are visible.
+	err := fsys.c.Flush()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if name != "." {
+		info, err := fsys.fileInfo(name)
+		if err == nil {
+			var r io.ReadCloser
+			r, err = fsys.c.NewReader(name)
+			if err == nil {
+				return &fsFile{ReadCloser: r, info: info}, nil
+			}
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	entries, err := fsys.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &fsDir{
+		info: fileInfo{
+			name: path.Base(name),
+			mode: fs.ModeDir | 0o555,
+		},
+		entries: entries,
+	}, nil
+}
+
+func (fsys cacheFS) fileInfo(key string) (info fileInfo, err error) {
+	err = fsys.c.wrapTxMethod(func(tx *Tx) (err error) {
+		cols, err := tx.conn.openKey(key)
+		if err != nil {
+			return
+		}
+		info.modTime, err = tx.conn.lastUsed(cols.id)
+		info.size = cols.valueLength()
+		return
+	})
+	info.name = path.Base(key)
+	info.mode = 0o444
+	return
+}
+
+// Returns the files and directories directly in dir, sorted by name.
+func (fsys cacheFS) readDir(dir string) (entries []fs.DirEntry, err error) {
+	prefix := ""
+	if dir != "." {
+		prefix = dir + "/"
+	}
+	// Expired keys that haven't been deleted yet are skipped, as they are by openKey.
+	query := `
+		select key, coalesce(uncompressed_length, length), last_used
+		from keys left join key_compression using (key_id) left join key_expiries using (key_id)
+		where not coalesce(expires <= ` + nowMillisSql + `, false) and key >= ?`
+	bounds := []any{prefix}
+	if upper, ok := prefixUpperBound(prefix); ok {
+		query += " and key < ?"
+		bounds = append(bounds, upper)
+	}
+	byName := make(map[string]fs.DirEntry)
+	err = fsys.c.wrapTxMethod(func(tx *Tx) error {
+		args := append([]any{tx.conn.nowArg()}, bounds...)
+		return tx.conn.sqliteQuery(query, func(stmt *sqlite.Stmt) error {
+			name := strings.TrimPrefix(stmt.ColumnText(0), prefix)
+			if i := strings.IndexByte(name, '/'); i >= 0 {
+				name = name[:i]
+				if _, ok := byName[name]; !ok && name != "" {
+					byName[name] = fs.FileInfoToDirEntry(fileInfo{
+						name: name,
+						mode: fs.ModeDir | 0o555,
+					})
+				}
+				return nil
+			}
+			if name == "" {
+				return nil
+			}
+			// Files take precedence over directories with the same name, as they do in Open.
+			byName[name] = fs.FileInfoToDirEntry(fileInfo{
+				name:    name,
+				size:    stmt.ColumnInt64(1),
+				mode:    0o444,
+				modTime: timeFromStmtColumn(stmt, 2),
+			})
+			return nil
+		}, args...)
+	})
+	for _, entry := range byName {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any           { return nil }
+
+type fsFile struct {
+	io.ReadCloser
+	info fileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Allows http.FileServer to serve ranges.
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	return f.ReadCloser.(io.Seeker).Seek(offset, whence)
+}
+
+type fsDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if n <= 0 {
+		entries, d.entries = d.entries, nil
+		return
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = g.Min(n, len(d.entries))
+	entries, d.entries = d.entries[:n], d.entries[n:]
+	return
+}
@@ -0,0 +1,158 @@
+package squirrel
+
+import (
+	"fmt"
+	"math"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Indexed values are addressed by a key and an index, instead of encoding the index into the key.
+// They're separate from the value stored for the key itself, and from other keys. They're stored
+// as is: NewCacheOpts.Compression and BlobCrypter don't apply to them.
+
+const indexedKeyWhere = "key_id=(select key_id from key_indices where key=? and idx=?)"
+
+func checkIndex(index uint64) error {
+	if index > math.MaxInt64 {
+		return fmt.Errorf("index %v is greater than %v", index, int64(math.MaxInt64))
+	}
+	return nil
+}
+
+func (c *Cache) PutIndexed(key string, index uint64, b []byte) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.PutIndexed(key, index, b)
+	})
+}
+
+func (tx *Tx) PutIndexed(key string, index uint64, b []byte) (err error) {
+	err = checkIndex(index)
+	if err != nil {
+		return
+	}
+	err = tx.DeleteIndexed(key, index)
+	if err != nil && err != ErrNotFound {
+		return
+	}
+	conn := tx.conn
+	var keyId rowid
+	err = conn.sqliteQueryMustOneRow(
+		`insert into keys (length, create_time, last_used)
+		values (?, `+nowMillisSql+`, `+nowMillisSql+`) returning key_id`,
+		func(stmt *sqlite.Stmt) error {
+			keyId = stmt.ColumnInt64(0)
+			return nil
+		},
+		len(b), conn.nowArg(), conn.nowArg(),
+	)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(`insert into key_indices (key_id, key, idx) values (?, ?, ?)`, keyId, key, int64(index))
+	if err != nil {
+		return
+	}
+	err = conn.storeKeyCost(keyId)
+	if err != nil {
+		return
+	}
+	err = conn.allocateBlobs(keyId, 0, int64(len(b)))
+	if err != nil || len(b) == 0 {
+		return
+	}
+	_, err = conn.valueIoAt(keyId, int64(len(b)), b, 0, true)
+	return
+}
+
+// Returns the indexed value in a new slice. This counts as an access.
+func (c *Cache) GetIndexed(key string, index uint64) (b []byte, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		b, err = tx.GetIndexed(key, index)
+		return
+	})
+	return
+}
+
+func (tx *Tx) GetIndexed(key string, index uint64) (b []byte, err error) {
+	err = checkIndex(index)
+	if err != nil {
+		return
+	}
+	cols, _, err := tx.conn.openKeyWhere(indexedKeyWhere, key, int64(index))
+	if err != nil {
+		return
+	}
+	b = make([]byte, cols.valueLength())
+	_, err = tx.readFull(cols, b)
+	if err != nil {
+		return nil, err
+	}
+	g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+	return
+}
+
+func (c *Cache) DeleteIndexed(key string, index uint64) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.DeleteIndexed(key, index)
+	})
+}
+
+func (tx *Tx) DeleteIndexed(key string, index uint64) (err error) {
+	err = checkIndex(index)
+	if err != nil {
+		return
+	}
+	var keyId rowid
+	ok, err := tx.conn.sqliteQueryRow(
+		"delete from keys where "+indexedKeyWhere+" returning key_id",
+		func(stmt *sqlite.Stmt) error {
+			keyId = stmt.ColumnInt64(0)
+			return nil
+		},
+		key, int64(index),
+	)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return tx.conn.forgetBlobsForKeyId(keyId)
+}
+
+// Calls f with each index stored for key and the length of its value, in order, until f returns
+// false. The indices are collected before f is called, so f can use the Cache.
+func (c *Cache) IterIndices(key string, f func(index uint64, length int64) bool) (err error) {
+	type indexLength struct {
+		index  uint64
+		length int64
+	}
+	var indices []indexLength
+	err = c.wrapTxMethod(func(tx *Tx) error {
+		return tx.conn.sqliteQuery(
+			`
+				select idx, length from key_indices join keys using (key_id)
+				where key_indices.key=?
+				order by idx`,
+			func(stmt *sqlite.Stmt) error {
+				indices = append(indices, indexLength{
+					index:  uint64(stmt.ColumnInt64(0)),
+					length: stmt.ColumnInt64(1),
+				})
+				return nil
+			},
+			key,
+		)
+	})
+	if err != nil {
+		return
+	}
+	for _, il := range indices {
+		if !f(il.index, il.length) {
+			break
+		}
+	}
+	return
+}
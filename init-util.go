@@ -17,17 +17,31 @@ func (me ErrUnexpectedJournalMode) Error() string {
 	return fmt.Sprintf("unexpected journal mode: %q", me.JournalMode)
 }
 
-func setSynchronous(conn sqliteConn, syncInt int) (err error) {
-	err = sqlitex.ExecTransient(conn, fmt.Sprintf(`pragma synchronous=%v`, syncInt), nil)
+// Returned when a pragma would be set to a value that isn't valid for it.
+type ErrInvalidPragmaValue struct {
+	Pragma string
+	Value  any
+}
+
+func (me ErrInvalidPragmaValue) Error() string {
+	return fmt.Sprintf("invalid value for pragma %v: %v", me.Pragma, me.Value)
+}
+
+func setSynchronous(conn sqliteConn, mode SynchronousMode) (err error) {
+	// SQLite ignores values it doesn't recognize.
+	if !mode.valid() {
+		return ErrInvalidPragmaValue{Pragma: "synchronous", Value: mode}
+	}
+	err = sqlitex.ExecTransient(conn, fmt.Sprintf(`pragma synchronous=%v`, mode), nil)
 	if err != nil {
 		return err
 	}
 	var (
-		actual   int
+		actual   SynchronousMode
 		actualOk bool
 	)
 	err = sqlitex.ExecTransient(conn, `pragma synchronous`, func(stmt *sqlite.Stmt) error {
-		actual = stmt.ColumnInt(0)
+		actual = SynchronousMode(stmt.ColumnInt(0))
 		actualOk = true
 		return nil
 	})
@@ -37,12 +51,21 @@ func setSynchronous(conn sqliteConn, syncInt int) (err error) {
 	if !actualOk {
 		return errors.New("synchronous setting query didn't return anything")
 	}
-	if actual != syncInt {
-		return fmt.Errorf("set synchronous %q, got %q", syncInt, actual)
+	if actual != mode {
+		return fmt.Errorf("set synchronous %v, got %v", mode, actual)
 	}
 	return nil
 }
 
+func setTempStore(conn sqliteConn, ts TempStore) error {
+	if !ts.valid() {
+		return ErrInvalidPragmaValue{Pragma: "temp_store", Value: ts}
+	}
+	// The pragma returns the setting as an integer. It won't change if sqlite was compiled to
+	// ignore it.
+	return setAndMaybeVerifyPragma(conn, "temp_store", ts, g.Some[any](int(ts)))
+}
+
 func setAndVerifyPragma(conn sqliteConn, name string, value any) (err error) {
 	return setAndMaybeVerifyPragma(conn, name, value, g.Some(value))
 }
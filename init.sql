@@ -40,3 +40,76 @@ create table if not exists tags (
     value any,
     primary key (key_id, tag_name)
 ) strict, without rowid;
+
+create index if not exists tags_name_value on tags(tag_name, value);
+
+create table if not exists key_costs (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    cost integer not null
+) strict;
+
+create table if not exists key_expiries (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    expires integer not null
+) strict;
+
+create index if not exists key_expiries_expires on key_expiries(expires);
+
+create table if not exists blob_hashes (
+    blob_id integer primary key references blobs(blob_id) on delete cascade,
+    hash blob not null
+) strict;
+
+create table if not exists blob_checksums (
+    blob_id integer primary key references blobs(blob_id) on delete cascade,
+    checksum integer not null
+) strict;
+
+create table if not exists key_compression (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    compression integer not null,
+    uncompressed_length integer not null
+) strict;
+
+create table if not exists key_encryption (
+    key_id integer primary key references keys(key_id) on delete cascade
+) strict;
+
+create table if not exists key_written_ranges (
+    key_id integer references keys(key_id) on delete cascade,
+    offset integer not null,
+    length integer not null,
+    primary key (key_id, offset)
+) strict, without rowid;
+
+create table if not exists dedup_contents (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    hash blob not null unique
+) strict;
+
+create table if not exists key_dedup (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    content_key_id integer not null references keys(key_id)
+) strict;
+
+create index if not exists key_dedup_content on key_dedup(content_key_id);
+
+-- Content values are deleted with the last key referring to them.
+create trigger if not exists key_dedup_release after delete on key_dedup
+when not exists (select 1 from key_dedup where content_key_id=old.content_key_id)
+begin
+    delete from keys where key_id=old.content_key_id;
+end;
+
+-- Values addressed by key and index. Their keys rows have a null key.
+create table if not exists key_indices (
+    key_id integer primary key references keys(key_id) on delete cascade,
+    key text not null,
+    idx integer not null,
+    unique (key, idx)
+) strict;
+
+-- Values stored with PutJSON, so QueryJSON can skip other values.
+create table if not exists json_values (
+    key_id integer primary key references keys(key_id) on delete cascade
+) strict;
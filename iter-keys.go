@@ -0,0 +1,90 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Used to stop iterKeysQuery early without an error.
+var errStopIter = errors.New("stop iteration")
+
+// Calls f with each key that starts with prefix, in order, until f returns false. The keys are
+// collected before f is called, so f can use the Cache.
+func (c *Cache) IterKeys(prefix string, f func(key string) bool) (err error) {
+	iter := func(key string) error {
+		if !f(key) {
+			return errStopIter
+		}
+		return nil
+	}
+	if upper, ok := prefixUpperBound(prefix); ok {
+		err = c.iterKeysQuery("select key from keys where key >= ? and key < ? order by key", iter, prefix, upper)
+	} else {
+		err = c.iterKeysQuery("select key from keys where key >= ? order by key", iter, prefix)
+	}
+	if err == errStopIter {
+		err = nil
+	}
+	return
+}
+
+// Returns the least string greater than all strings with the prefix. There isn't one if the prefix
+// is empty or all 0xff bytes.
+func prefixUpperBound(prefix string) (upper string, ok bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return
+}
+
+// Calls f with keys in order of least recent use, which is the eviction order for EvictLRU, until f
+// returns false. At most limit keys are visited if it's positive. The keys are collected before f
+// is called, so f can use the Cache.
+func (c *Cache) IterByLastUsed(limit int, f func(key string, lastUsed time.Time, accessCount int64) bool) (err error) {
+	type keyUse struct {
+		key         string
+		lastUsed    time.Time
+		accessCount int64
+	}
+	var keys []keyUse
+	if limit <= 0 {
+		limit = -1
+	}
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	err = c.wrapTxMethod(func(tx *Tx) error {
+		return tx.conn.sqliteQuery(
+			fmt.Sprintf(
+				"select key, last_used, access_count from keys where key is not null order by %v limit ?",
+				EvictLRU.orderBy(),
+			),
+			func(stmt *sqlite.Stmt) error {
+				keys = append(keys, keyUse{
+					key:         stmt.ColumnText(0),
+					lastUsed:    timeFromStmtColumn(stmt, 1),
+					accessCount: stmt.ColumnInt64(2),
+				})
+				return nil
+			},
+			limit,
+		)
+	})
+	if err != nil {
+		return
+	}
+	for _, k := range keys {
+		if !f(k.key, k.lastUsed, k.accessCount) {
+			break
+		}
+	}
+	return
+}
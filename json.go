@@ -0,0 +1,106 @@
+package squirrel
+
+import (
+	"encoding/json"
+	"errors"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Stores v encoded as JSON.
+func (c *Cache) PutJSON(key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.TxImmediate(func(tx *Tx) error {
+		err := tx.Put(key, b)
+		if err != nil {
+			return err
+		}
+		// Replacing or deleting the key removes the mark.
+		return tx.conn.sqliteExec(
+			`insert into json_values (key_id) select key_id from keys where key=?`,
+			key,
+		)
+	})
+}
+
+// Decodes the JSON value for key into out.
+func (c *Cache) GetJSON(key string, out any) error {
+	b, err := c.ReadAll(key, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Calls f with the element at path (in SQLite JSON path syntax, like "$.a.b") for each value
+// stored with PutJSON that has it. Values are read in full to do this. Access isn't recorded.
+func (c *Cache) QueryJSON(path string, f func(key string, val any) error) (err error) {
+	type result struct {
+		key  string
+		json []byte
+	}
+	var results []result
+	err = c.Tx(func(tx *Tx) (err error) {
+		results = nil
+		var keys []string
+		err = tx.conn.sqliteQuery(
+			`select key from json_values join keys using (key_id) order by key`,
+			func(stmt *sqlite.Stmt) error {
+				keys = append(keys, stmt.ColumnText(0))
+				return nil
+			},
+		)
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			cols, err := tx.conn.openKey(key)
+			if errors.Is(err, ErrNotFound) {
+				// Expired.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			value := make([]byte, cols.valueLength())
+			_, err = tx.readFull(cols, value)
+			if err != nil {
+				return err
+			}
+			// Bound as text, since SQLite treats blobs as its binary JSON format.
+			err = tx.conn.sqliteQueryMaxOneRow(
+				`select json_quote(json_extract(?1, ?2)) where json_type(?1, ?2) is not null`,
+				func(stmt *sqlite.Stmt) error {
+					results = append(results, result{
+						key:  key,
+						json: []byte(stmt.ColumnText(0)),
+					})
+					return nil
+				},
+				string(value), path,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	for _, r := range results {
+		var val any
+		err = json.Unmarshal(r.json, &val)
+		if err != nil {
+			return
+		}
+		err = f(r.key, val)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
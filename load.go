@@ -0,0 +1,38 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returns the value for key, or if it doesn't exist, calls load and stores the value it returns
+// with Put. Concurrent calls for the same key share a single call to load. If storing the loaded
+// value fails, it's returned along with the error.
+func (c *Cache) GetOrLoad(key string, load func() ([]byte, error)) (b []byte, err error) {
+	b, err = c.Get(key)
+	if !errors.Is(err, ErrNotFound) {
+		return
+	}
+	v, err, shared := c.loads.Do(key, func() (any, error) {
+		// The value may have been stored since we looked, by a call that has finished loading.
+		b, err := c.Get(key)
+		if !errors.Is(err, ErrNotFound) {
+			return b, err
+		}
+		b, err = load()
+		if err != nil {
+			return nil, err
+		}
+		err = c.Put(key, b)
+		if err != nil {
+			err = fmt.Errorf("storing loaded value: %w", err)
+		}
+		return b, err
+	})
+	b, _ = v.([]byte)
+	if shared {
+		// Callers own the slices returned to them.
+		b = append([]byte(nil), b...)
+	}
+	return
+}
@@ -0,0 +1,441 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Runs with on a conn while holding the single writer lock. This is for writes that can't be done
+// in a Tx.
+func (c *Cache) withWriteConn(with func(conn) error) error {
+	c.singleWriter.Lock()
+	defer c.singleWriter.Unlock()
+	return c.withConn(with)
+}
+
+// Returns freelist pages to the filesystem with incremental_vacuum until free pages are at most
+// maxFreeRatio of the total pages. Unlike VACUUM, this doesn't rewrite the whole file. auto_vacuum
+// must be incremental (see InitDbOpts.SetAutoVacuum).
+func (c *Cache) TrimFreeSpace(maxFreeRatio float64) error {
+	if maxFreeRatio < 0 || maxFreeRatio >= 1 {
+		return fmt.Errorf("max free ratio %v not in [0, 1)", maxFreeRatio)
+	}
+	return c.withWriteConn(func(c conn) (err error) {
+		autoVacuum, err := c.execPragmaReturningInt64("auto_vacuum")
+		if err != nil {
+			return
+		}
+		if autoVacuum != 2 {
+			return fmt.Errorf("auto_vacuum is %v, incremental vacuum requires 2", autoVacuum)
+		}
+		for {
+			var free, total int64
+			free, err = c.execPragmaReturningInt64("freelist_count")
+			if err != nil {
+				return
+			}
+			total, err = c.execPragmaReturningInt64("page_count")
+			if err != nil {
+				return
+			}
+			if free == 0 || float64(free) <= maxFreeRatio*float64(total) {
+				return
+			}
+			// Freeing n pages also removes them from the total.
+			n := int64(math.Ceil((float64(free) - maxFreeRatio*float64(total)) / (1 - maxFreeRatio)))
+			err = c.sqliteExecTransient(fmt.Sprintf("pragma incremental_vacuum(%d)", g.Max(n, 1)))
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Maintenance to perform when closing a Cache.
+type CloseOpts struct {
+	// Checkpoint and truncate the WAL, if the database is in WAL mode.
+	Checkpoint bool
+	// Rebuild the database file to reclaim free pages.
+	Vacuum bool
+	// Run pragma optimize, as recommended by SQLite before closing a connection.
+	Optimize bool
+}
+
+// Runs pragma optimize to update the statistics used by the query planner.
+func (c *Cache) Optimize() error {
+	return c.withWriteConn(func(c conn) error {
+		return c.sqliteExec("pragma optimize")
+	})
+}
+
+// Performs the requested maintenance and then closes the Cache. The Cache is closed even if
+// maintenance fails.
+func (c *Cache) CloseOpts(opts CloseOpts) (err error) {
+	if c.stopAutoCheckpoint != nil {
+		c.stopAutoCheckpoint()
+	}
+	err = c.Flush()
+	opts.Optimize = opts.Optimize || c.opts.OptimizeOnClose
+	if err == nil && opts != (CloseOpts{}) && !c.isClosed() {
+		err = c.withWriteConn(func(c conn) (err error) {
+			if opts.Vacuum {
+				err = c.vacuum()
+				if err != nil {
+					return fmt.Errorf("vacuuming: %w", err)
+				}
+			}
+			// After vacuuming, as that writes the whole database through the WAL.
+			if opts.Checkpoint {
+				err = c.sqliteExec("pragma wal_checkpoint(truncate)")
+				if err != nil {
+					return fmt.Errorf("checkpointing: %w", err)
+				}
+			}
+			if opts.Optimize {
+				err = c.sqliteExec("pragma optimize")
+				if err != nil {
+					return fmt.Errorf("optimizing: %w", err)
+				}
+			}
+			return
+		})
+	}
+	return errors.Join(err, c.closeConns())
+}
+
+// Closes the Cache and removes its database file, along with the files SQLite keeps alongside it.
+// Caches without a file of their own, such as in-memory ones and those from NewCacheFromConn, are
+// just closed. It can be called after the Cache is already closed.
+func (c *Cache) CloseAndRemove() (err error) {
+	err = c.Close()
+	if c.opts.inMemory() || c.opts.Path == "" || !c.ownsConn {
+		return
+	}
+	return errors.Join(err, removeDatabaseFiles(c.opts.Path))
+}
+
+// Returns the journal mode currently in effect, which may differ from InitConnOpts.SetJournalMode
+// if the database file couldn't adopt it.
+func (c *Cache) JournalMode() (mode string, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		mode, err = c.execPragmaReturningText("journal_mode")
+		return
+	})
+	return
+}
+
+// Runs pragma integrity_check and pragma foreign_key_check, returning the problems reported. No
+// problems means the database is OK.
+func (c *Cache) IntegrityCheck() (problems []string, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		problems, err = c.checkPragma("integrity_check")
+		if err != nil {
+			return
+		}
+		return c.sqliteQuery("pragma foreign_key_check", func(stmt *sqlite.Stmt) error {
+			problems = append(problems, fmt.Sprintf(
+				"foreign key %v violated by row %v in %q referencing %q",
+				stmt.ColumnInt64(3),
+				stmt.ColumnInt64(1),
+				stmt.ColumnText(0),
+				stmt.ColumnText(2),
+			))
+			return nil
+		})
+	})
+	return
+}
+
+// The rows removed by Repair.
+type RepairReport struct {
+	// "values" rows referring to keys or blobs that don't exist.
+	OrphanedValues int64
+	// Blobs that no "values" row refers to.
+	OrphanedBlobs int64
+}
+
+// Deletes "values" rows and blobs that aren't reachable from a key, as could be left by writes made
+// without foreign key enforcement. It runs in a single transaction.
+func (c *Cache) Repair() (report RepairReport, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		conn := tx.conn
+		conn.closeBlobs()
+		err = conn.sqliteExec(`
+			delete from "values"
+			where value_id not in (select key_id from keys) or blob_id not in (select blob_id from blobs)`,
+		)
+		if err != nil {
+			return
+		}
+		report.OrphanedValues = int64(conn.sqliteConn.Changes())
+		err = conn.sqliteExec(`delete from blobs where blob_id not in (select blob_id from "values")`)
+		if err != nil {
+			return
+		}
+		report.OrphanedBlobs = int64(conn.sqliteConn.Changes())
+		return
+	})
+	if err != nil {
+		report = RepairReport{}
+	}
+	return
+}
+
+// Like IntegrityCheck, but runs pragma quick_check, which is much faster for large databases.
+func (c *Cache) QuickCheck() (problems []string, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		problems, err = c.checkPragma("quick_check")
+		return
+	})
+	return
+}
+
+// Returns the rows reported by a check pragma, excluding the single "ok" row if there are no
+// problems.
+func (c conn) checkPragma(pragma string) (problems []string, err error) {
+	err = c.sqliteQuery("pragma "+pragma, func(stmt *sqlite.Stmt) error {
+		problems = append(problems, stmt.ColumnText(0))
+		return nil
+	})
+	if len(problems) == 1 && problems[0] == "ok" {
+		problems = nil
+	}
+	return
+}
+
+// Deletes keys in eviction order until the Cache is within its capacity and key limits, in a
+// single transaction. This also occurs at the end of every write transaction. freed is the total
+// length of the deleted values.
+func (c *Cache) TrimToCapacity() (evicted int, freed int64, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		evicted, freed, err = tx.conn.trimToCapacity()
+		return
+	})
+	if err != nil {
+		evicted, freed = 0, 0
+	}
+	return
+}
+
+// Changes the capacity, and trims to it in the same transaction. Negative removes the limit, and
+// zero restores the capacity the Cache was opened with.
+func (c *Cache) SetCapacity(capacity int64) (err error) {
+	target := g.Some(capacity)
+	if capacity < 0 {
+		target.SetNone()
+	} else if capacity == 0 {
+		target = c.defaultCapacity
+	}
+	err = c.TxImmediate(func(tx *Tx) error {
+		if !target.Ok {
+			return tx.conn.unlimitCapacity()
+		}
+		return tx.conn.setCapacity(target.Value)
+	})
+	if err != nil {
+		return
+	}
+	// So conns opened later don't restore the capacity the Cache was opened with.
+	c.l.Lock()
+	c.opts.Capacity = target.UnwrapOr(-1)
+	c.l.Unlock()
+	return
+}
+
+// A value that TrimPreview reports would be deleted.
+type TrimPreviewValue struct {
+	Key string
+	// Set for indexed values.
+	Index  g.Option[uint64]
+	Length int64
+}
+
+// Returns the values that would be deleted, in order, if capacity were targetCapacity, and their
+// total length. Nothing is deleted. Bytes used by the database are estimated to fall by the length
+// of each value deleted, so this is approximate unless NewCacheOpts.CostFunc is set. Limits on the
+// number of keys aren't considered.
+func (c *Cache) TrimPreview(targetCapacity int64) (values []TrimPreviewValue, freed int64, err error) {
+	err = c.wrapTxMethod(func(tx *Tx) (err error) {
+		conn := tx.conn
+		var used int64
+		if conn.costFunc != nil {
+			used, err = conn.totalCost()
+		} else {
+			used, err = conn.bytesUsed()
+		}
+		if err != nil || used <= targetCapacity {
+			return
+		}
+		err = conn.sqliteQuery(
+			fmt.Sprintf(`
+				select coalesce(keys.key, key_indices.key), idx, length, coalesce(cost, length)
+				from keys left join key_costs using (key_id) left join key_indices using (key_id)
+				where key_id not in (select key_id from dedup_contents)
+				order by %v`,
+				conn.evictionPolicy.orderBy(),
+			),
+			func(stmt *sqlite.Stmt) error {
+				v := TrimPreviewValue{
+					Key:    stmt.ColumnText(0),
+					Length: stmt.ColumnInt64(2),
+				}
+				if stmt.ColumnType(1) != sqlite.TypeNull {
+					v.Index.Set(uint64(stmt.ColumnInt64(1)))
+				}
+				values = append(values, v)
+				freed += v.Length
+				if conn.costFunc != nil {
+					used -= stmt.ColumnInt64(3)
+				} else {
+					used -= v.Length
+				}
+				if used <= targetCapacity {
+					return errStopIter
+				}
+				return nil
+			},
+		)
+		if err == errStopIter {
+			err = nil
+		}
+		return
+	})
+	if err != nil {
+		values, freed = nil, 0
+	}
+	return
+}
+
+// Rebuilds the database file, returning all free pages to the filesystem. VACUUM can't run in a
+// transaction, so this fails with SQLITE_BUSY while PinnedBlobs or other transactions are open on
+// the database, unless it's in WAL mode. In WAL mode the rebuilt database is written to the WAL,
+// which grows to the size of the database until it's checkpointed (see CloseOpts.Checkpoint).
+func (c *Cache) Vacuum() (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.withWriteConn(func(c conn) error {
+		return c.vacuum()
+	})
+}
+
+func (c conn) vacuum() error {
+	// Cached blob handles are statements that would prevent VACUUM.
+	c.closeBlobs()
+	return c.sqliteExec("vacuum")
+}
+
+// Returns up to pages free pages to the filesystem, or all of them if pages is not positive. This
+// only has an effect if auto_vacuum is incremental (see InitDbOpts.SetAutoVacuum).
+func (c *Cache) IncrementalVacuum(pages int) error {
+	return c.withWriteConn(func(c conn) error {
+		return c.sqliteExecTransient(fmt.Sprintf("pragma incremental_vacuum(%d)", g.Max(pages, 0)))
+	})
+}
+
+// A mode for pragma wal_checkpoint. See https://www.sqlite.org/pragma.html#pragma_wal_checkpoint.
+type CheckpointMode string
+
+const (
+	CheckpointPassive  CheckpointMode = "passive"
+	CheckpointFull     CheckpointMode = "full"
+	CheckpointRestart  CheckpointMode = "restart"
+	CheckpointTruncate CheckpointMode = "truncate"
+)
+
+func (mode CheckpointMode) valid() bool {
+	switch mode {
+	case CheckpointPassive, CheckpointFull, CheckpointRestart, CheckpointTruncate:
+		return true
+	}
+	return false
+}
+
+// Checkpoints the WAL, returning what sqlite reports: whether the checkpoint was blocked (busy),
+// the number of frames in the WAL, and the number of frames checkpointed. Fails if the database
+// isn't in WAL mode.
+func (c *Cache) Checkpoint(mode CheckpointMode) (busy, log, checkpointed int, err error) {
+	err = c.withWriteConn(func(c conn) (err error) {
+		busy, log, checkpointed, err = c.checkpoint(mode)
+		return
+	})
+	return
+}
+
+func (c conn) checkpoint(mode CheckpointMode) (busy, log, checkpointed int, err error) {
+	if !mode.valid() {
+		err = fmt.Errorf("unknown checkpoint mode %q", mode)
+		return
+	}
+	journalMode, err := c.execPragmaReturningText("journal_mode")
+	if err != nil {
+		return
+	}
+	if journalMode != "wal" {
+		err = fmt.Errorf("journal mode is %q, not wal", journalMode)
+		return
+	}
+	err = c.sqliteQueryMustOneRow(
+		fmt.Sprintf("pragma wal_checkpoint(%v)", mode),
+		func(stmt *sqlite.Stmt) error {
+			busy = stmt.ColumnInt(0)
+			log = stmt.ColumnInt(1)
+			checkpointed = stmt.ColumnInt(2)
+			return nil
+		},
+	)
+	return
+}
+
+// Makes transactions committed so far durable, when commits aren't synced because of
+// InitConnOpts.SetSynchronous. In WAL mode the WAL is checkpointed, and otherwise a write is
+// committed, with synchronous=full so the files are synced. Does nothing if synchronous is already
+// full or extra.
+func (c *Cache) Sync() (err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	return c.withWriteConn(func(c conn) error {
+		return c.sync()
+	})
+}
+
+func (c conn) sync() (err error) {
+	synchronous, err := c.execPragmaReturningInt64("synchronous")
+	if err != nil {
+		return
+	}
+	// 2 is full, and 3 is extra.
+	if synchronous >= 2 {
+		return
+	}
+	journalMode, err := c.execPragmaReturningText("journal_mode")
+	if err != nil {
+		return
+	}
+	err = c.sqliteExec("pragma synchronous=full")
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, c.sqliteExecTransient(fmt.Sprintf("pragma synchronous=%d", synchronous)))
+	}()
+	if journalMode == "wal" {
+		var busy int
+		busy, _, _, err = c.checkpoint(CheckpointFull)
+		if err == nil && busy != 0 {
+			err = errors.New("checkpoint blocked by readers")
+		}
+		return
+	}
+	return c.sqliteExec(`
+		insert or replace into cache_meta (key, value)
+		values ('last_sync', cast(unixepoch('subsec')*1e3 as integer))`,
+	)
+}
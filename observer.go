@@ -0,0 +1,63 @@
+package squirrel
+
+import (
+	"errors"
+)
+
+// Receives events from a Cache for monitoring, such as hit rates and contention. Methods are called
+// synchronously, so they should be fast, and must not use the Cache.
+type Observer interface {
+	// A value was read by ReadFull, ReadAll or Get.
+	OnHit(key string)
+	// ReadFull, ReadAll or Get found no value for key.
+	OnMiss(key string)
+	// A value of length n was written by Put.
+	OnPut(key string, n int)
+	// A key was deleted when trimming to capacity, after the transaction committed. Evictions of
+	// indexed values are only observed if the Observer implements IndexedEvictObserver.
+	OnEvict(key string, length int64)
+	// A transaction is being retried because the database was busy.
+	OnBusyRetry()
+}
+
+// Optionally implemented by an Observer to receive evictions of indexed values.
+type IndexedEvictObserver interface {
+	// An indexed value was deleted when trimming to capacity, after the transaction committed.
+	OnEvictIndexed(key string, index uint64, length int64)
+}
+
+func (c *Cache) observeRead(key string, err error) {
+	if c.opts.Observer == nil {
+		return
+	}
+	if err == nil {
+		c.opts.Observer.OnHit(key)
+	} else if errors.Is(err, ErrNotFound) {
+		c.opts.Observer.OnMiss(key)
+	}
+}
+
+func (c *Cache) observePut(key string, n int, err error) {
+	if c.opts.Observer != nil && err == nil {
+		c.opts.Observer.OnPut(key, n)
+	}
+}
+
+// Reports an eviction to NewCacheOpts.OnEvict or OnEvictIndexed, and the Observer.
+func (c *Cache) observeEvict(e evictedKey) {
+	if !e.index.Ok {
+		if c.opts.OnEvict != nil {
+			c.opts.OnEvict(e.key, e.length)
+		}
+		if c.opts.Observer != nil {
+			c.opts.Observer.OnEvict(e.key, e.length)
+		}
+		return
+	}
+	if c.opts.OnEvictIndexed != nil {
+		c.opts.OnEvictIndexed(e.key, e.index.Value, e.length)
+	}
+	if o, ok := c.opts.Observer.(IndexedEvictObserver); ok {
+		o.OnEvictIndexed(e.key, e.index.Value, e.length)
+	}
+}
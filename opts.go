@@ -1,11 +1,71 @@
 package squirrel
 
 import (
+	"fmt"
+
 	g "github.com/anacrolix/generics"
 )
 
+// A value for pragma synchronous. See https://www.sqlite.org/pragma.html#pragma_synchronous.
+type SynchronousMode int
+
+const (
+	SynchronousOff SynchronousMode = iota
+	SynchronousNormal
+	SynchronousFull
+	SynchronousExtra
+)
+
+func (mode SynchronousMode) String() string {
+	switch mode {
+	case SynchronousOff:
+		return "off"
+	case SynchronousNormal:
+		return "normal"
+	case SynchronousFull:
+		return "full"
+	case SynchronousExtra:
+		return "extra"
+	default:
+		return fmt.Sprintf("SynchronousMode(%d)", int(mode))
+	}
+}
+
+func (mode SynchronousMode) valid() bool {
+	return mode >= SynchronousOff && mode <= SynchronousExtra
+}
+
+// A value for pragma temp_store, which is where temporary tables and indices are kept. See
+// https://www.sqlite.org/pragma.html#pragma_temp_store.
+type TempStore int
+
+const (
+	// Use the compile-time default, which is usually files.
+	TempStoreDefault TempStore = iota
+	TempStoreFile
+	TempStoreMemory
+)
+
+func (ts TempStore) String() string {
+	switch ts {
+	case TempStoreDefault:
+		return "default"
+	case TempStoreFile:
+		return "file"
+	case TempStoreMemory:
+		return "memory"
+	default:
+		return fmt.Sprintf("TempStore(%d)", int(ts))
+	}
+}
+
+func (ts TempStore) valid() bool {
+	return ts >= TempStoreDefault && ts <= TempStoreMemory
+}
+
 type InitConnOpts struct {
-	SetSynchronous int
+	// The zero value is SynchronousOff.
+	SetSynchronous SynchronousMode
 	SetJournalMode string
 	MmapSizeOk     bool  // If false, a package-specific default will be used.
 	MmapSize       int64 // If MmapSizeOk is set, use sqlite default if < 0, otherwise this value.
@@ -17,17 +77,33 @@ type InitConnOpts struct {
 	LengthLimit      g.Option[int]
 	JournalSizeLimit g.Option[int64]
 	MaxPageCount     g.Option[uint32]
+	// Applies sqlite3 pragma soft_heap_limit, in bytes. Note that this limit is for the whole
+	// process, not just the conn, so the last value set by any Cache applies to all of them.
+	SoftHeapLimit g.Option[int64]
+	// Applies sqlite3 pragma temp_store. Keeping temporary data in memory avoids temporary files
+	// for large transactions and sorts, at the cost of memory. See also CacheSize, which limits
+	// how much of a transaction is held in memory before it spills to the database file.
+	TempStore g.Option[TempStore]
 }
 
 // Fields are in order of how they should be used during initialization.
 type InitDbOpts struct {
 	SetAutoVacuum     g.Option[string]
 	RequireAutoVacuum g.Option[any]
-	PageSize          int
-	DontInitSchema    bool
-	NoTriggers        bool
+	// Applies to new databases. If an existing database has a different page size, opening it
+	// returns ErrPageSizeImmutable.
+	PageSize       int
+	DontInitSchema bool
+	NoTriggers     bool
+	// Prefixed to the names of squirrel's tables and indexes, so they can coexist with other
+	// tables in the same database.
+	TablePrefix string
 	// If non-zero, overrides the existing setting. Less than zero is unlimited.
 	Capacity int64
+	// The maximum number of keys. Keys are trimmed in the same order as for Capacity, and both can
+	// apply at once. Indexed values don't count, and aren't trimmed for it. If non-zero, overrides
+	// the existing setting. Less than zero is unlimited.
+	MaxKeys int64
 }
 
 type NewConnOpts struct {
@@ -36,7 +112,38 @@ type NewConnOpts struct {
 	// automatically deleted as soon as the database connection is closed."
 	Path   string
 	Memory bool
+	// Opens a named in-memory database with shared cache. Caches in the same process opened with the
+	// same MemoryName see the same data. The database is freed when its last conn is closed.
+	// Overrides Path and Memory.
+	MemoryName string
 	// sqlite3 has a default limit of 1GB. Due to integer types used internally, I think it's not
-	// possible to go over 2GiB-1.
+	// possible to go over 2GiB-1. Defaults to 1MiB. Larger blobs reduce per-row overhead for large
+	// values, and smaller blobs reduce the cost of partial writes. It can be changed for existing
+	// databases.
 	MaxBlobSize g.Option[maxBlobSizeType]
+	// Opens the database with the immutable=1 URI parameter. SQLite will skip locking and change
+	// detection entirely, so this must only be used for files that genuinely can't change, such as
+	// a prebuilt cache on read-only media. The database is opened read-only, and squirrel won't
+	// attempt any writes, including schema initialization and access tracking.
+	ImmutableFile bool
+	// The name of a registered SQLite VFS to open the database with. The default VFS is used if
+	// empty.
+	VFS string
+	// Added to the query of the URI used to open the database, for parameters like nolock or psow
+	// (see https://www.sqlite.org/uri.html). Parameters set by other options can't be overridden.
+	URIParams map[string]string
+	// Opens the database read-only. It must already exist and have the schema. Access isn't
+	// tracked, and squirrel won't attempt any writes. Unlike ImmutableFile, other processes can
+	// still write to the database.
+	ReadOnly bool
+}
+
+// Whether the database only exists in memory.
+func (opts NewConnOpts) inMemory() bool {
+	return opts.Memory || opts.MemoryName != ""
+}
+
+// Whether the conn must not be written to.
+func (opts NewConnOpts) readOnly() bool {
+	return opts.ReadOnly || opts.ImmutableFile
 }
@@ -0,0 +1,52 @@
+package squirrel
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	g "github.com/anacrolix/generics"
+)
+
+// Returns the number of PinnedBlobs opened from the Cache that haven't been closed. Each holds a
+// conn and transaction open, so this should not grow without bound.
+func (c *Cache) OpenPinnedCount() int {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return len(c.pinnedBlobs)
+}
+
+// Describes the PinnedBlobs opened from the Cache that haven't been closed. If
+// NewCacheOpts.TrackPinnedBlobCallers is set, the stack of the caller that opened each is included.
+// This is intended for finding leaks.
+func (c *Cache) PinnedBlobDebug() (ret []string) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	for pb, stack := range c.pinnedBlobs {
+		s := fmt.Sprintf("%q", pb.key)
+		if stack != "" {
+			s += " opened at:\n" + stack
+		}
+		ret = append(ret, s)
+	}
+	return
+}
+
+// Returns the current stack if pinned blob callers are being tracked.
+func (c *Cache) pinnedBlobCaller() string {
+	if !c.opts.TrackPinnedBlobCallers {
+		return ""
+	}
+	return string(debug.Stack())
+}
+
+func (c *Cache) addPinnedBlob(pb *PinnedBlob, caller string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	g.MakeMapIfNilAndSet(&c.pinnedBlobs, pb, caller)
+}
+
+func (c *Cache) removePinnedBlob(pb *PinnedBlob) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.pinnedBlobs, pb)
+}
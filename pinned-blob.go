@@ -1,20 +1,22 @@
 package squirrel
 
 import (
-	g "github.com/anacrolix/generics"
-	"io"
 	"time"
 
-	"github.com/go-llsqlite/adapter"
+	g "github.com/anacrolix/generics"
 )
 
 // Wraps a specific sqlite.Blob instance, when we don't want to dive into the cache to refetch
-// blobs. Until Closed, PinnedBlob holds a transaction open on the Cache.
+// blobs. Until Closed, PinnedBlob holds a transaction open on the Cache. Methods are safe for
+// concurrent use, including with other PinnedBlobs from the same Tx: they're serialized on the Tx,
+// as they share its conn. They must not be used concurrently with the Tx's own methods.
 type PinnedBlob struct {
 	key     string
 	write   bool
 	tx      *Tx
 	valueId rowid
+	// Guarded by tx.mu.
+	closed bool
 }
 
 // This is very cheap for this type.
@@ -27,7 +29,7 @@ func (pb *PinnedBlob) Length() int64 {
 }
 
 func (pb *PinnedBlob) closedErr() error {
-	if pb.tx == nil {
+	if pb.closed {
 		return ErrClosed
 	}
 	return nil
@@ -35,6 +37,8 @@ func (pb *PinnedBlob) closedErr() error {
 
 // This is very cheap for this type.
 func (pb *PinnedBlob) LengthErr() (_ int64, err error) {
+	pb.tx.mu.Lock()
+	defer pb.tx.mu.Unlock()
 	err = pb.closedErr()
 	if err != nil {
 		return
@@ -44,16 +48,17 @@ func (pb *PinnedBlob) LengthErr() (_ int64, err error) {
 
 // Requires only that we lock the sqlite conn.
 func (pb *PinnedBlob) ReadAt(b []byte, valueOff int64) (n int, err error) {
-	return pb.doIoAt(b, valueOff, (*sqlite.Blob).ReadAt, false)
+	return pb.doIoAt(b, valueOff, false)
 }
 
 // Requires only that we lock the sqlite conn.
 func (pb *PinnedBlob) doIoAt(
 	b []byte,
 	valueOff int64,
-	blobCall func(*sqlite.Blob, []byte, int64) (int, error),
 	write bool,
 ) (n int, err error) {
+	pb.tx.mu.Lock()
+	defer pb.tx.mu.Unlock()
 	err = pb.closedErr()
 	if err != nil {
 		return
@@ -63,56 +68,33 @@ func (pb *PinnedBlob) doIoAt(
 	if err != nil {
 		return
 	}
-	if valueOff >= l {
-		err = io.EOF
-		return
-	}
-	err = conn.iterBlobs(
-		pb.valueId,
-		func(blobOff int64, blob *sqlite.Blob) (more bool, err error) {
-			readOff := valueOff - blobOff
-			if readOff < 0 {
-				return false, nil
-			}
-			if readOff >= blob.Size() {
-				return true, nil
-			}
-			b1 := b
-			if int64(len(b1)) > blob.Size()-readOff {
-				b1 = b[:blob.Size()-readOff]
-			}
-			n1, err := blobCall(blob, b1, readOff)
-			n += n1
-			b = b[n1:]
-			valueOff += int64(n1)
-			if n1 == len(b1) && err == io.EOF {
-				err = nil
-			}
-			if err != nil {
-				return
-			}
-			more = len(b) != 0
-			return
-		},
-		write,
-		valueOff,
-	)
+	n, err = conn.valueIoAt(pb.valueId, l, b, valueOff, write)
 	if n != 0 {
 		g.MakeMapIfNilAndSet(&pb.tx.accessedKeys, pb.valueId, struct{}{})
 	}
+	if write && n != 0 {
+		// Keep io.EOF from a short write unless recording fails.
+		if recordErr := conn.recordWritten(pb.valueId, valueOff, int64(n)); recordErr != nil {
+			err = recordErr
+		}
+	}
 	return
 }
 
 func (pb *PinnedBlob) WriteAt(b []byte, off int64) (n int, err error) {
-	return pb.doIoAt(b, off, (*sqlite.Blob).WriteAt, true)
+	return pb.doIoAt(b, off, true)
 }
 
 func (pb *PinnedBlob) Close() error {
-	pb.tx = nil
+	pb.tx.mu.Lock()
+	defer pb.tx.mu.Unlock()
+	pb.closed = true
 	return nil
 }
 
 func (pb *PinnedBlob) LastUsed() (lastUsed time.Time, err error) {
+	pb.tx.mu.Lock()
+	defer pb.tx.mu.Unlock()
 	err = pb.closedErr()
 	if err != nil {
 		return
@@ -0,0 +1,97 @@
+package squirrel
+
+import (
+	"fmt"
+	"sort"
+)
+
+type PutItem struct {
+	Key   string
+	Value []byte
+}
+
+// Determines what PutMulti does when a key occurs more than once in a batch.
+type DuplicateKeyPolicy int
+
+const (
+	// The last value for the key is stored.
+	DuplicateKeysLastWins DuplicateKeyPolicy = iota
+	// The first value for the key is stored.
+	DuplicateKeysFirstWins
+	// The batch fails with ErrDuplicateKey.
+	DuplicateKeysError
+)
+
+type PutMultiOpts struct {
+	DuplicateKeys DuplicateKeyPolicy
+}
+
+type ErrDuplicateKey struct {
+	Key string
+}
+
+func (me ErrDuplicateKey) Error() string {
+	return fmt.Sprintf("duplicate key %q", me.Key)
+}
+
+// Puts all the items in a single transaction. If any item fails, none are stored.
+func (c *Cache) PutMulti(items []PutItem, opts PutMultiOpts) (err error) {
+	items, err = resolveDuplicateKeys(items, opts.DuplicateKeys)
+	if err != nil {
+		return
+	}
+	return c.TxImmediate(func(tx *Tx) error {
+		for _, item := range items {
+			err := tx.Put(item.Key, item.Value)
+			if err != nil {
+				return fmt.Errorf("putting %q: %w", item.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Puts all the items in a single transaction, in key order. If any item fails, none are stored.
+// Use PutMulti to control the order.
+func (c *Cache) PutBatch(items map[string][]byte) error {
+	putItems := make([]PutItem, 0, len(items))
+	for key, value := range items {
+		putItems = append(putItems, PutItem{Key: key, Value: value})
+	}
+	sort.Slice(putItems, func(i, j int) bool {
+		return putItems[i].Key < putItems[j].Key
+	})
+	return c.PutMulti(putItems, PutMultiOpts{})
+}
+
+// Returns the items that should be stored, in their original order.
+func resolveDuplicateKeys(items []PutItem, policy DuplicateKeyPolicy) (ret []PutItem, err error) {
+	winners := make(map[string]int, len(items))
+	for i, item := range items {
+		_, dup := winners[item.Key]
+		if !dup {
+			winners[item.Key] = i
+			continue
+		}
+		switch policy {
+		case DuplicateKeysLastWins:
+			winners[item.Key] = i
+		case DuplicateKeysFirstWins:
+		case DuplicateKeysError:
+			err = ErrDuplicateKey{item.Key}
+			return
+		default:
+			panic(policy)
+		}
+	}
+	if len(winners) == len(items) {
+		return items, nil
+	}
+	ret = make([]PutItem, 0, len(winners))
+	for i, item := range items {
+		if winners[item.Key] == i {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
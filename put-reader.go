@@ -0,0 +1,54 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+
+	g "github.com/anacrolix/generics"
+)
+
+// Replaces the value for key with length bytes read from r, a blob at a time, so the value needn't
+// fit in memory. Bytes after length aren't read. If r ends early, nothing is stored and
+// io.ErrUnexpectedEOF is returned. Like values written through PinnedBlobs, the value isn't
+// compressed or encrypted.
+func (c *Cache) PutReader(key string, r io.Reader, length int64) (written int64, err error) {
+	// r can't be read again if the transaction is retried.
+	err = c.txImmediateOnce(func(tx *Tx) (err error) {
+		written, err = tx.PutReader(key, r, length)
+		return
+	})
+	return
+}
+
+func (tx *Tx) PutReader(key string, r io.Reader, length int64) (written int64, err error) {
+	if length < 0 {
+		err = errors.New("negative length")
+		return
+	}
+	err = tx.Delete(key)
+	if err != nil && err != ErrNotFound {
+		return
+	}
+	keyId, _, err := tx.conn.createKey(key, CreateOpts{Length: length})
+	if err != nil {
+		return
+	}
+	buf := make([]byte, g.Min(length, tx.conn.maxBlobSize))
+	for written < length {
+		b := buf[:g.Min(int64(len(buf)), length-written)]
+		var n int
+		n, err = io.ReadFull(r, b)
+		written += int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+		_, err = tx.conn.valueIoAt(keyId, length, b, written-int64(n), true)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
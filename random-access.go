@@ -0,0 +1,80 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+
+	g "github.com/anacrolix/generics"
+)
+
+// Reads from the value for key at off, like io.ReaderAt, without holding a PinnedBlob open.
+func (c *Cache) ReadAt(key string, b []byte, off int64) (n int, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		n, err = tx.ReadAt(key, b, off)
+		if err == io.EOF {
+			// Don't roll back the access.
+			return nil
+		}
+		return
+	})
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Reads from the value for key at off, like io.ReaderAt. Compressed and encrypted values are read
+// in full to do this.
+func (tx *Tx) ReadAt(key string, b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		err = errors.New("negative offset")
+		return
+	}
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	if cols.checkPinnable() != nil {
+		value := make([]byte, cols.valueLength())
+		_, err = tx.readFull(cols, value)
+		if err != nil {
+			return
+		}
+		if off < int64(len(value)) {
+			n = copy(b, value[off:])
+		}
+		if n < len(b) {
+			err = io.EOF
+		}
+	} else {
+		n, err = tx.conn.valueIoAt(cols.id, cols.length, b, off, false)
+	}
+	if n != 0 {
+		g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+	}
+	return
+}
+
+// Writes b to the value for key at off, like io.WriterAt, without holding a PinnedBlob open. The
+// value is created or extended as needed.
+func (c *Cache) WriteAt(key string, b []byte, off int64) (n int, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		n, err = tx.WriteAt(key, b, off)
+		return
+	})
+	if err != nil {
+		n = 0
+	}
+	return
+}
+
+// Writes b to the value for key at off, like io.WriterAt. The value is created, or extended with
+// zeroes, to cover the write. Compressed and encrypted values can't be written in place.
+func (tx *Tx) WriteAt(key string, b []byte, off int64) (n int, err error) {
+	pb, err := tx.OpenPinnedWritable(key, off+int64(len(b)))
+	if err != nil {
+		return
+	}
+	defer pb.Close()
+	return pb.WriteAt(b, off)
+}
@@ -0,0 +1,167 @@
+package squirrel
+
+import (
+	"fmt"
+	"io"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// A region of a value.
+type Range struct {
+	Off int64
+	Len int64
+}
+
+func (r Range) End() int64 {
+	return r.Off + r.Len
+}
+
+// Returns the regions of the value that are backed by blobs, in order, with adjacent regions
+// merged. For values that aren't sparse, this is the entire value. Access isn't recorded.
+func (c *Cache) PresentRanges(key string) (ret []Range, err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	err = c.withConn(func(c conn) (err error) {
+		keyCols, err := c.openKey(key)
+		if err != nil {
+			return
+		}
+		ret, err = c.presentRanges(keyCols.id)
+		return
+	})
+	return
+}
+
+func (conn conn) presentRanges(valueId rowid) (ret []Range, err error) {
+	err = conn.sqliteQuery(
+		sqlQuery(`
+			select offset, length(blob)
+			from "values" join blobs using (blob_id)
+			where value_id=?
+			order by offset`,
+		),
+		func(stmt *sqlite.Stmt) error {
+			r := Range{
+				Off: stmt.ColumnInt64(0),
+				Len: stmt.ColumnInt64(1),
+			}
+			if len(ret) != 0 && ret[len(ret)-1].End() == r.Off {
+				ret[len(ret)-1].Len += r.Len
+			} else {
+				ret = append(ret, r)
+			}
+			return nil
+		},
+		valueId,
+	)
+	return
+}
+
+// Reads the ranges of the value for key into dst contiguously, in one pass over its blobs. The
+// ranges must be in order, not overlap, and be within the value.
+func (tx *Tx) ReadRanges(key string, ranges []Range, dst []byte) (err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	err = checkRanges(ranges, cols.valueLength(), int64(len(dst)))
+	if err != nil {
+		return
+	}
+	if cols.checkPinnable() != nil {
+		value := make([]byte, cols.valueLength())
+		_, err = tx.readFull(cols, value)
+		if err != nil {
+			return
+		}
+		for _, r := range ranges {
+			dst = dst[copy(dst, value[r.Off:r.End()]):]
+		}
+	} else {
+		err = tx.conn.readRanges(cols, ranges, dst)
+		if err != nil {
+			return
+		}
+	}
+	g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+	return
+}
+
+func checkRanges(ranges []Range, length, dstLen int64) error {
+	var prevEnd, total int64
+	for _, r := range ranges {
+		if r.Len < 0 || r.Off < prevEnd || r.End() > length {
+			return fmt.Errorf("range %+v is out of order, overlapping or outside value of length %v", r, length)
+		}
+		prevEnd = r.End()
+		total += r.Len
+	}
+	if total > dstLen {
+		return fmt.Errorf("ranges total %v bytes, but dst has length %v", total, dstLen)
+	}
+	return nil
+}
+
+func (conn conn) readRanges(key keyCols, ranges []Range, dst []byte) (err error) {
+	pending := make([]Range, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Len != 0 {
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	err = conn.iterBlobs(
+		key.id,
+		func(blobOff int64, blob *sqlite.Blob) (more bool, err error) {
+			blobEnd := blobOff + blob.Size()
+			for len(pending) != 0 {
+				r := &pending[0]
+				if r.Off < blobOff {
+					// A gap in a sparse value. The rest is read below.
+					return false, nil
+				}
+				if r.Off >= blobEnd {
+					return true, nil
+				}
+				n := g.Min(r.End(), blobEnd) - r.Off
+				var n1 int
+				n1, err = conn.blobReadAt(blob, dst[:n], r.Off-blobOff)
+				if int64(n1) == n && err == io.EOF {
+					err = nil
+				}
+				if err != nil {
+					return
+				}
+				dst = dst[n:]
+				r.Off += n
+				r.Len -= n
+				if r.Len == 0 {
+					pending = pending[1:]
+				}
+			}
+			return false, nil
+		},
+		false,
+		pending[0].Off,
+	)
+	if err != nil {
+		return
+	}
+	for _, r := range pending {
+		_, err = conn.valueIoAt(key.id, key.length, dst[:r.Len], r.Off, false)
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+		dst = dst[r.Len:]
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package squirrel
+
+import (
+	"sync"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Borrows a value stored in a single blob when mmap is enabled (see InitConnOpts.MmapSize). The
+// slice is a view of memory owned by SQLite: it points directly into the mapping when the blob
+// fits in a page, and into SQLite's own buffer otherwise. A read transaction is held open until
+// release is called, and the slice must not be used or modified after that. Compressed, encrypted
+// and deduplicated values aren't mappable. Returns ErrNotMappable if the preconditions aren't met,
+// in which case callers should fall back to ReadAll.
+func (c *Cache) ReadMapped(key string) (b []byte, release func(), err error) {
+	if !c.opts.MmapSizeOk || c.opts.MmapSize <= 0 {
+		err = ErrNotMappable
+		return
+	}
+	ready := make(chan struct{})
+	released := make(chan struct{})
+	txFinished := make(chan struct{})
+	borrowed := false
+	go func() {
+		defer close(txFinished)
+		// The transaction can't be rerun once the slice has been handed out.
+		txErr := c.txOnce(func(tx *Tx) (err error) {
+			cols, err := tx.conn.openKey(key)
+			if err != nil {
+				return
+			}
+			err = cols.checkPinnable()
+			if err != nil {
+				return ErrNotMappable
+			}
+			var blobs int
+			err = tx.conn.sqliteQueryMustOneRow(
+				`select count(*) from "values" where value_id=?`,
+				func(stmt *sqlite.Stmt) error {
+					blobs = stmt.ColumnInt(0)
+					return nil
+				},
+				cols.id,
+			)
+			if err != nil {
+				return
+			}
+			if blobs != 1 {
+				return ErrNotMappable
+			}
+			g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+			// The view is only valid while the statement is on this row.
+			return tx.conn.sqliteQueryMustOneRow(
+				`select blob from blobs join "values" using (blob_id) where value_id=?`,
+				func(stmt *sqlite.Stmt) error {
+					b = stmtColumnViewBytes(stmt, 0)
+					borrowed = true
+					close(ready)
+					<-released
+					return nil
+				},
+				cols.id,
+			)
+		})
+		if !borrowed {
+			err = txErr
+			close(ready)
+		}
+	}()
+	<-ready
+	if !borrowed {
+		b = nil
+		return
+	}
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(released)
+			<-txFinished
+		})
+	}
+	return
+}
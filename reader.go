@@ -0,0 +1,114 @@
+package squirrel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	g "github.com/anacrolix/generics"
+)
+
+// Streams a value from a PinnedBlob, so it sees a consistent snapshot of the value.
+type valueReader struct {
+	pb  CachePinnedBlob
+	off int64
+}
+
+func (r *valueReader) Read(b []byte) (n int, err error) {
+	n, err = r.pb.ReadAt(b, r.off)
+	r.off += int64(n)
+	return
+}
+
+func (r *valueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		length, err := r.pb.LengthErr()
+		if err != nil {
+			return r.off, err
+		}
+		offset += length
+	default:
+		return r.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return r.off, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *valueReader) Close() error {
+	return r.pb.Close()
+}
+
+// Whether err is from checkPinnable. Such values can still be read in full.
+func isNotPinnableErr(err error) bool {
+	return errors.Is(err, ErrCompressed) || errors.Is(err, ErrEncrypted) || errors.Is(err, ErrDeduplicated)
+}
+
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// Returns a reader that streams the value for key from the start, returning io.EOF at its length.
+// The reader also implements io.Seeker. It holds a read transaction open until it's closed.
+func (c *Cache) NewReader(key string) (io.ReadCloser, error) {
+	pb, err := c.OpenPinnedReadOnly(key)
+	if isNotPinnableErr(err) {
+		// The value must be read in full anyway.
+		var b []byte
+		b, err = c.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return bytesReadCloser{bytes.NewReader(b)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &valueReader{pb: pb}, nil
+}
+
+type rangeReader struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// Returns a reader for the part of the value for key from off, of up to length bytes. It returns
+// io.EOF at the end of the range, or the value if that's sooner, and seeks relative to the start of
+// the range. Like NewReader, it holds a read transaction open until it's closed.
+func (c *Cache) OpenRange(key string, off, length int64) (io.ReadSeekCloser, error) {
+	if off < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range: offset %v, length %v", off, length)
+	}
+	pb, err := c.OpenPinnedReadOnly(key)
+	if isNotPinnableErr(err) {
+		var b []byte
+		b, err = c.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		b = b[g.Min(off, int64(len(b))):]
+		b = b[:g.Min(length, int64(len(b)))]
+		return bytesReadCloser{bytes.NewReader(b)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	valueLength, err := pb.LengthErr()
+	if err != nil {
+		return nil, errors.Join(err, pb.Close())
+	}
+	off = g.Min(off, valueLength)
+	length = g.Min(length, valueLength-off)
+	return rangeReader{io.NewSectionReader(pb, off, length), pb}, nil
+}
@@ -0,0 +1,38 @@
+package squirrel
+
+import (
+	"errors"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Renames oldKey to newKey without copying the value. Returns ErrNotFound if oldKey doesn't exist,
+// and ErrKeyExists if newKey does.
+func (c *Cache) Rename(oldKey, newKey string) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.Rename(oldKey, newKey)
+	})
+}
+
+func (tx *Tx) Rename(oldKey, newKey string) (err error) {
+	cols, err := tx.conn.openKey(oldKey)
+	if err != nil {
+		return
+	}
+	if oldKey == newKey {
+		return
+	}
+	// Make way for the rename if newKey has expired.
+	_, expired, err := tx.conn.openKeyIncludingExpired(newKey)
+	if err == nil && expired {
+		err = tx.conn.deleteKey(newKey)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return
+	}
+	err = tx.conn.sqliteExec("update keys set key=? where key_id=?", newKey, cols.id)
+	if sqlite.IsResultCode(err, sqlite.ResultCodeConstraintUnique) {
+		err = ErrKeyExists{newKey}
+	}
+	return
+}
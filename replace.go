@@ -0,0 +1,93 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// The tables a database must have to be used by a Cache.
+var schemaTables = []string{"keys", "values", "blobs", "setting", "tags"}
+
+// Switches the Cache to the database at path, which must already have the schema. Callers are
+// blocked while in-flight operations complete and the conns are reopened. Values buffered for
+// write-behind are flushed to the old database first.
+func (c *Cache) ReplaceWith(path string) (err error) {
+	if !c.ownsConn {
+		return errors.New("can't replace the database of a Cache using a provided conn")
+	}
+	err = validateSchemaAtPath(path, c.opts.TablePrefix)
+	if err != nil {
+		return fmt.Errorf("validating %q: %w", path, err)
+	}
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	err = c.getCacheErr()
+	if err != nil {
+		return
+	}
+	c.replacing = true
+	defer func() {
+		c.replacing = false
+		c.closeCond.Broadcast()
+	}()
+	for c.connsInUse != 0 {
+		c.closeCond.Wait()
+	}
+	oldOpts := c.opts
+	c.opts.Path = path
+	c.opts.Memory = false
+	c.opts.MemoryName = ""
+	newConn, err := c.newConn()
+	if err != nil {
+		c.opts = oldOpts
+		return
+	}
+	for len(c.conns) != 0 {
+		err = errors.Join(err, c.popConn().Close())
+	}
+	c.addConn(newConn)
+	return
+}
+
+func validateSchemaAtPath(path string, tablePrefix string) (err error) {
+	// Open read-only so the file isn't created if it doesn't exist.
+	uri, err := newOpenUri(NewConnOpts{Path: path})
+	if err != nil {
+		return
+	}
+	conn, err := sqlite.OpenConn(uri, openReadOnlyConnFlags)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var missing []string
+	for _, table := range schemaTables {
+		var found bool
+		err = sqlitex.Exec(
+			conn,
+			"select 1 from sqlite_master where type='table' and name=?",
+			func(stmt *sqlite.Stmt) error {
+				found = true
+				return nil
+			},
+			tablePrefix+table,
+		)
+		if err != nil {
+			return
+		}
+		if !found {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) != 0 {
+		err = fmt.Errorf("missing tables %q", missing)
+	}
+	return
+}
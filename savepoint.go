@@ -0,0 +1,32 @@
+package squirrel
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// Runs f in a savepoint within the transaction. If f returns an error, its changes are rolled back
+// and the error is returned, and the rest of the transaction is unaffected. Savepoints can be
+// nested, and names can be reused. Open blob handles prevent savepoint operations, so blob handles
+// cached by the Tx are closed first, and PinnedBlobs opened in the Tx must not be used across a
+// savepoint.
+func (tx *Tx) Savepoint(name string, f func() error) (err error) {
+	quoted := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	err = tx.execSavepoint("savepoint " + quoted)
+	if err != nil {
+		return
+	}
+	err = f()
+	if err != nil {
+		// Rolling back to a savepoint leaves it on the stack, so it's released either way.
+		return errors.Join(err, tx.execSavepoint("rollback to "+quoted), tx.execSavepoint("release "+quoted))
+	}
+	return tx.execSavepoint("release " + quoted)
+}
+
+func (tx *Tx) execSavepoint(query string) error {
+	tx.conn.closeBlobs()
+	return sqlitex.ExecTransient(tx.conn.sqliteConn, query, nil)
+}
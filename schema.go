@@ -0,0 +1,82 @@
+package squirrel
+
+import (
+	"fmt"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// The version of the schema created by init.sql. Increment it when init.sql changes in a way that
+// existing databases need migrating for, and append the migration to migrations.
+const schemaVersion = 1
+
+// migrations[i] migrates an existing database from schema version i to i+1. They run before
+// init.sql, which then creates anything missing.
+var migrations = []func(conn sqliteConn, tablePrefix string) error{
+	// Databases from before versioning only lack tables and indexes that init.sql creates if they
+	// don't exist.
+	func(sqliteConn, string) error { return nil },
+}
+
+// Returns the schema version of the database, which is 0 if it predates versioning, and whether
+// the schema exists at all.
+func getSchemaVersion(conn sqliteConn, tablePrefix string) (version int, exists bool, err error) {
+	err = sqlitex.Exec(
+		conn,
+		"select count(*) from sqlite_master where type='table' and name=?",
+		func(stmt *sqlite.Stmt) error {
+			exists = stmt.ColumnInt(0) != 0
+			return nil
+		},
+		tablePrefix+"setting",
+	)
+	if err != nil || !exists {
+		return
+	}
+	err = sqlitex.Exec(
+		conn,
+		prefixTableNames(tablePrefix, "select value from setting where name='schema_version'"),
+		func(stmt *sqlite.Stmt) error {
+			version = stmt.ColumnInt(0)
+			return nil
+		},
+	)
+	return
+}
+
+// Applies the migrations from fromVersion to the current schema version, in order.
+func migrate(conn sqliteConn, tablePrefix string, fromVersion int) (err error) {
+	if fromVersion > schemaVersion {
+		return fmt.Errorf("schema version %v is newer than supported version %v", fromVersion, schemaVersion)
+	}
+	for version := fromVersion; version < schemaVersion; version++ {
+		err = migrations[version](conn, tablePrefix)
+		if err != nil {
+			return fmt.Errorf("migrating from schema version %v: %w", version, err)
+		}
+	}
+	return
+}
+
+func setSchemaVersion(conn sqliteConn, tablePrefix string) error {
+	return sqlitex.Exec(
+		conn,
+		prefixTableNames(tablePrefix, "insert into setting values ('schema_version', ?)"),
+		nil,
+		schemaVersion,
+	)
+}
+
+// Returns the schema version of the database. See SchemaVersionSupported.
+func (c *Cache) SchemaVersion() (version int, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		version, _, err = getSchemaVersion(c.sqliteConn, c.tablePrefix)
+		return
+	})
+	return
+}
+
+// The schema version created by this package. Older databases are migrated when they're opened,
+// and newer ones are refused.
+const SchemaVersionSupported = schemaVersion
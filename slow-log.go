@@ -0,0 +1,31 @@
+package squirrel
+
+import (
+	"time"
+)
+
+// Reports operations that take longer than a threshold.
+type slowLogger struct {
+	threshold time.Duration
+	log       func(op string, dur time.Duration, key string)
+}
+
+// Calls the slow log if it's set and the operation begun at started has taken too long. key may be
+// empty if the operation isn't for a specific key.
+func (me slowLogger) check(op string, key string, started time.Time) {
+	if me.log == nil {
+		return
+	}
+	dur := time.Since(started)
+	if dur < me.threshold {
+		return
+	}
+	me.log(op, dur, key)
+}
+
+func (opts NewCacheOpts) slowLogger() slowLogger {
+	return slowLogger{
+		threshold: opts.SlowThreshold,
+		log:       opts.SlowLog,
+	}
+}
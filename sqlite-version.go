@@ -0,0 +1,74 @@
+package squirrel
+
+import (
+	"fmt"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// The oldest SQLite version with all the features squirrel relies on.
+const MinSQLiteVersion = "3.42.0"
+
+// Features of the linked SQLite library that squirrel relies on.
+type Capabilities struct {
+	Version string
+	// unixepoch('subsec'), used for access times. Added in 3.42.0.
+	SubsecTime bool
+	// The returning clause, used when creating and deleting keys. Added in 3.35.0.
+	Returning bool
+	// Strict tables, used by the schema. Added in 3.37.0.
+	StrictTables bool
+	// The JSON functions are available.
+	JSON bool
+}
+
+// Whether everything squirrel relies on is available.
+func (me Capabilities) Ok() bool {
+	return me.SubsecTime && me.Returning && me.StrictTables
+}
+
+// Returns the version of the linked SQLite library.
+func (c *Cache) SQLiteVersion() (version string, err error) {
+	err = c.withConn(func(c conn) error {
+		return c.sqliteQueryMustOneRow("select sqlite_version()", func(stmt *sqlite.Stmt) error {
+			version = stmt.ColumnText(0)
+			return nil
+		})
+	})
+	return
+}
+
+// Detects features of the linked SQLite library.
+func (c *Cache) Capabilities() (ret Capabilities, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		err = c.sqliteQueryMustOneRow("select sqlite_version()", func(stmt *sqlite.Stmt) error {
+			ret.Version = stmt.ColumnText(0)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		ret.Returning = sqliteVersionAtLeast(ret.Version, 3, 35, 0)
+		ret.StrictTables = sqliteVersionAtLeast(ret.Version, 3, 37, 0)
+		// These are probed, since they depend on more than the version.
+		ret.SubsecTime = c.sqliteExec("select unixepoch('subsec')") == nil
+		ret.JSON = c.sqliteExec("select json('{}')") == nil
+		return
+	})
+	return
+}
+
+// Compares a version as returned by sqlite_version() against the given version.
+func sqliteVersionAtLeast(version string, major, minor, patch int) bool {
+	var actual [3]int
+	_, err := fmt.Sscanf(version, "%d.%d.%d", &actual[0], &actual[1], &actual[2])
+	if err != nil {
+		return false
+	}
+	for i, want := range [3]int{major, minor, patch} {
+		if actual[i] != want {
+			return actual[i] > want
+		}
+	}
+	return true
+}
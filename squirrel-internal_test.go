@@ -1,9 +1,11 @@
 package squirrel
 
 import (
+	"context"
 	squirrelTesting "github.com/anacrolix/squirrel/internal/testing"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/log"
 	qt "github.com/frankban/quicktest"
@@ -78,3 +80,330 @@ func TestSeekingBlobBtree(t *testing.T) {
 	it.Last()
 	qtc.Assert(it.Cur(), qt.Equals, valueKey{1, 1})
 }
+
+func TestSqliteVersionAtLeast(t *testing.T) {
+	qtc := qt.New(t)
+	qtc.Check(sqliteVersionAtLeast("3.42.0", 3, 42, 0), qt.IsTrue)
+	qtc.Check(sqliteVersionAtLeast("3.43.1", 3, 42, 0), qt.IsTrue)
+	qtc.Check(sqliteVersionAtLeast("3.41.9", 3, 42, 0), qt.IsFalse)
+	qtc.Check(sqliteVersionAtLeast("4.0.0", 3, 42, 0), qt.IsTrue)
+	qtc.Check(sqliteVersionAtLeast("bogus", 3, 42, 0), qt.IsFalse)
+}
+
+func TestPrefixTableNames(t *testing.T) {
+	qtc := qt.New(t)
+	qtc.Check(
+		prefixTableNames("sq_", `select key from keys join "values" on value_id=keys.key_id where key=?`),
+		qt.Equals,
+		`select key from sq_keys join "sq_values" on value_id=sq_keys.key_id where key=?`,
+	)
+	qtc.Check(
+		prefixTableNames("sq_", `insert into keys (key, length) values (?, ?) returning key_id`),
+		qt.Equals,
+		`insert into sq_keys (key, length) values (?, ?) returning key_id`,
+	)
+	qtc.Check(prefixTableNames("", "select * from tags"), qt.Equals, "select * from tags")
+}
+
+func TestTablePrefix(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.TablePrefix = "squirrel_"
+	opts.MaxBlobSize.Set(2)
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("hello", []byte("world")), qt.IsNil)
+	qtc.Assert(cache.SetTag("hello", "verified", true), qt.IsNil)
+	value, err := cache.ReadAll("hello", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "world")
+	conn, err := newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	defer conn.Close()
+	var tables []string
+	qtc.Assert(sqlitex.Exec(conn, "select name from sqlite_master where type='table' order by name", func(stmt *sqlite.Stmt) error {
+		tables = append(tables, stmt.ColumnText(0))
+		return nil
+	}), qt.IsNil)
+	for _, table := range tables {
+		qtc.Check(table, qt.Matches, "squirrel_.*")
+	}
+}
+
+// Evicting a value deletes all its blobs, however many there are, in the same statement.
+func TestTrimValueSpanningManyBlobs(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.MaxBlobSize.Set(1 << 10)
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("small", []byte("hello")), qt.IsNil)
+	var used int64
+	qtc.Assert(cache.withConn(func(c conn) (err error) {
+		used, err = c.bytesUsed()
+		return
+	}), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	opts.Capacity = used + 16<<10
+	cache = TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("large", make([]byte, 64<<10)), qt.IsNil)
+	qtc.Assert(cache.withConn(func(c conn) error {
+		for _, table := range []string{"keys", `"values"`, "blobs"} {
+			var rows int64
+			err := c.sqliteQueryMustOneRow("select count(*) from "+table, func(stmt *sqlite.Stmt) error {
+				rows = stmt.ColumnInt64(0)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			qtc.Check(rows, qt.Equals, int64(0), qt.Commentf(table))
+		}
+		return nil
+	}), qt.IsNil)
+}
+
+// Compares the reused prepared statements of sqliteQuery with preparing the statement every time.
+func BenchmarkOpenKeyStatement(b *testing.B) {
+	qtc := qt.New(b)
+	cache := TestingNewCache(qtc, TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put("hello", []byte("world")), qt.IsNil)
+	const query = `select key_id, length from keys where key=?`
+	for _, transient := range []bool{false, true} {
+		exec := sqlitex.Exec
+		name := "Cached"
+		if transient {
+			exec = sqlitex.ExecTransient
+			name = "Transient"
+		}
+		b.Run(name, func(b *testing.B) {
+			qt.Assert(b, cache.withConn(func(c conn) error {
+				for i := 0; i < b.N; i++ {
+					err := exec(c.sqliteConn, query, nil, "hello")
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}), qt.IsNil)
+		})
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	cache := TestingNewCache(qtc, opts)
+	version, err := cache.SchemaVersion()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(version, qt.Equals, SchemaVersionSupported)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	setVersion := func(query string) {
+		conn, err := newSqliteConn(opts.NewConnOpts)
+		qtc.Assert(err, qt.IsNil)
+		defer conn.Close()
+		qtc.Assert(sqlitex.Exec(conn, query, nil), qt.IsNil)
+	}
+	// Databases from before versioning are migrated.
+	setVersion("delete from setting where name='schema_version'")
+	cache = TestingNewCache(qtc, opts)
+	version, err = cache.SchemaVersion()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(version, qt.Equals, SchemaVersionSupported)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	setVersion("update setting set value=value+1 where name='schema_version'")
+	_, err = NewCache(opts)
+	qtc.Check(err, qt.ErrorMatches, ".*newer than supported.*")
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.VerifyChecksums = true
+	opts.MaxBlobSize.Set(4)
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("a", []byte("hello world")), qt.IsNil)
+	b, err := cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "hello world")
+	// Partial writes update the checksums of the blobs they touch.
+	_, err = cache.WriteAt("a", []byte("w0r"), 6)
+	qtc.Assert(err, qt.IsNil)
+	b, err = cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "hello w0rld")
+	// Blobs written several times in a transaction are checksummed once, when it ends.
+	qtc.Assert(cache.TxImmediate(func(tx *Tx) error {
+		pb, err := tx.OpenPinnedWritable("a", 11)
+		qtc.Assert(err, qt.IsNil)
+		defer pb.Close()
+		for i, c := range []byte("WOR") {
+			_, err = pb.WriteAt([]byte{c}, int64(6+i))
+			qtc.Assert(err, qt.IsNil)
+		}
+		qtc.Check(tx.conn.unchecksummedBlobs, qt.HasLen, 2)
+		return nil
+	}), qt.IsNil)
+	b, err = cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "hello WORld")
+	qtc.Assert(cache.withConn(func(c conn) error {
+		return c.sqliteExec(`
+			update blobs set blob=cast('WOld' as blob) where blob_id=(
+				select blob_id from "values" where value_id=(select key_id from keys where key='a') and offset=4
+			)`,
+		)
+	}), qt.IsNil)
+	_, err = cache.Get("a")
+	qtc.Check(err, qt.ErrorIs, ErrChecksumMismatch{Key: "a", Offset: 4})
+}
+
+func TestRepair(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("hello", []byte("world")), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	// Foreign keys aren't enforced on a raw conn.
+	conn, err := newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(sqlitex.ExecScript(conn, `
+		insert into blobs (blob_id, blob) values (1000, x'00');
+		insert into blobs (blob_id, blob) values (1001, x'00');
+		insert into "values" (value_id, offset, blob_id) values (999, 0, 1001);
+		insert into "values" (value_id, offset, blob_id) values (
+			(select key_id from keys where key='hello'), 100, 2002);
+	`), qt.IsNil)
+	qtc.Assert(conn.Close(), qt.IsNil)
+	cache = TestingNewCache(qtc, opts)
+	problems, err := cache.IntegrityCheck()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.Not(qt.HasLen), 0)
+	report, err := cache.Repair()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(report, qt.Equals, RepairReport{OrphanedValues: 2, OrphanedBlobs: 1})
+	problems, err = cache.IntegrityCheck()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.HasLen, 0)
+	value, err := cache.Get("hello")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "world")
+}
+
+func TestURIParams(t *testing.T) {
+	qtc := qt.New(t)
+	uri, err := newOpenUri(NewConnOpts{
+		Path:      "cache.db",
+		URIParams: map[string]string{"vfs": "unix-dotfile", "psow": "0"},
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(uri, qt.Equals, "file:cache.db?psow=0&vfs=unix-dotfile")
+	_, err = newOpenUri(NewConnOpts{
+		MemoryName: "shared",
+		URIParams:  map[string]string{"cache": "private"},
+	})
+	qtc.Check(err, qt.ErrorMatches, `URI parameter "cache" conflicts with options`)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.URIParams = map[string]string{"vfs": "unix-dotfile"}
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("hello", []byte("world")), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	opts.URIParams = map[string]string{"vfs": "missing"}
+	_, err = NewCache(opts)
+	qtc.Check(err, qt.IsNotNil)
+}
+
+func TestVFS(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.VFS = "unix-dotfile"
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put("hello", []byte("world")), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	opts.VFS = "missing"
+	_, err := NewCache(opts)
+	qtc.Check(err, qt.ErrorMatches, `opening with vfs "missing": .*`)
+	opts.VFS = "unix-dotfile"
+	opts.URIParams = map[string]string{"vfs": "unix-none"}
+	_, err = NewCache(opts)
+	qtc.Check(err, qt.ErrorMatches, `URI parameter "vfs" conflicts with options`)
+}
+
+func TestTempStore(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.TempStore.Set(TempStoreMemory)
+	cache := TestingNewCache(qtc, opts)
+	qtc.Assert(cache.withConn(func(c conn) error {
+		ts, err := c.execPragmaReturningInt64("temp_store")
+		qtc.Check(ts, qt.Equals, int64(TempStoreMemory))
+		return err
+	}), qt.IsNil)
+	opts.TempStore.Set(TempStoreMemory + 1)
+	_, err := NewCache(opts)
+	qtc.Check(err, qt.ErrorAs, new(ErrInvalidPragmaValue))
+}
+
+func TestWaitUnderCapacityBlocks(t *testing.T) {
+	qtc := qt.New(t)
+	cache := TestingNewCache(qtc, TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, []byte("hello")), qt.IsNil)
+	}
+	// Lower the limit without trimming, so the Cache is over it.
+	qtc.Assert(cache.withConn(func(c conn) error {
+		return c.sqliteExec("insert into setting values ('max_keys', 2)")
+	}), qt.IsNil)
+	// Nothing can trim until this transaction ends.
+	pb, err := cache.Create("held", CreateOpts{Length: 1})
+	qtc.Assert(err, qt.IsNil)
+	waited := make(chan error, 1)
+	go func() {
+		waited <- cache.WaitUnderCapacity(context.Background())
+	}()
+	select {
+	case err := <-waited:
+		qtc.Fatalf("returned while over capacity: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Trims when it commits.
+	qtc.Assert(pb.Close(), qt.IsNil)
+	select {
+	case err := <-waited:
+		qtc.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		qtc.Fatal("still waiting after trimming")
+	}
+	qtc.Assert(cache.withConn(func(c conn) error {
+		return c.sqliteQueryMustOneRow("select count(*) from keys", func(stmt *sqlite.Stmt) error {
+			qtc.Check(stmt.ColumnInt(0), qt.Equals, 2)
+			return nil
+		})
+	}), qt.IsNil)
+}
+
+func TestTrimToCapacityEvicts(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	// Compare capacity to value lengths alone.
+	opts.CostFunc = func(key string, length int64) int64 {
+		return length
+	}
+	cache := TestingNewCache(qtc, opts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, []byte("hello")), qt.IsNil)
+	}
+	// Lower the capacity without trimming, so there's something to do.
+	qtc.Assert(cache.withConn(func(c conn) error {
+		return c.setCapacity(10)
+	}), qt.IsNil)
+	evicted, freed, err := cache.TrimToCapacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(evicted, qt.Equals, 1)
+	qtc.Check(freed, qt.Equals, int64(5))
+	limit, used, _, err := cache.Capacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(limit, qt.Equals, int64(10))
+	qtc.Check(used, qt.Equals, int64(10))
+	evicted, _, err = cache.TrimToCapacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(evicted, qt.Equals, 0)
+}
@@ -1,18 +1,28 @@
 package squirrel_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	squirrelTesting "github.com/anacrolix/squirrel/internal/testing"
 	"io"
+	"io/fs"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	_ "github.com/anacrolix/envpprof"
+	g "github.com/anacrolix/generics"
 	qt "github.com/frankban/quicktest"
 	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/anacrolix/squirrel"
@@ -215,7 +225,7 @@ func TestWriteVeryLargeBlob(t *testing.T) {
 	source := rand.NewSource(1)
 	randRdr := rand.New(source)
 	const valueLen int64 = 1 << 30
-	blob, err := cache.Create(defaultKey, squirrel.CreateOpts{valueLen})
+	blob, err := cache.Create(defaultKey, squirrel.CreateOpts{Length: valueLen})
 	qtc.Assert(err, qt.IsNil)
 	h := newFastestHash()
 	n, _ := io.Copy(io.MultiWriter(io.NewOffsetWriter(blob, 0), h), randRdr)
@@ -276,3 +286,2482 @@ func TestCreateChangeSize(t *testing.T) {
 	qtc.Check(err, qt.IsNil)
 	qtc.Check(string(value), qt.Equals, "mundo")
 }
+
+func TestIterKeysByTagExistence(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	qtc.Assert(cache.SetTag("a", "verified", true), qt.IsNil)
+	qtc.Assert(cache.SetTag("c", "verified", false), qt.IsNil)
+	qtc.Assert(cache.SetTag("b", "other", 1), qt.IsNil)
+	collect := func(iter func(tag string, f func(key string) error) error) (keys []string) {
+		err := iter("verified", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		qtc.Assert(err, qt.IsNil)
+		return
+	}
+	qtc.Check(collect(cache.IterKeysHavingTag), qt.DeepEquals, []string{"a", "c"})
+	qtc.Check(collect(cache.IterKeysMissingTag), qt.DeepEquals, []string{"b"})
+}
+
+func TestImmutableFile(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.ImmutableFile = true
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	qtc.Check(cache.Put(defaultKey, defaultValue), qt.IsNotNil)
+}
+
+func TestSlowLog(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	var ops []string
+	cacheOpts.SlowLog = func(op string, dur time.Duration, key string) {
+		ops = append(ops, op+":"+key)
+	}
+	cacheOpts.SlowThreshold = time.Hour
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Check(ops, qt.HasLen, 0)
+	cacheOpts.SlowThreshold = 0
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	var buf [5]byte
+	_, err := cache.ReadFull(defaultKey, buf[:])
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ops, qt.DeepEquals, []string{"tx:", "put:" + defaultKey, "tx:", "read full:" + defaultKey})
+}
+
+func TestOpenPinnedCount(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.TrackPinnedBlobCallers = true
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Check(cache.OpenPinnedCount(), qt.Equals, 0)
+	pb, err := cache.OpenPinnedReadOnly(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(cache.OpenPinnedCount(), qt.Equals, 1)
+	debug := cache.PinnedBlobDebug()
+	qtc.Assert(debug, qt.HasLen, 1)
+	qtc.Check(debug[0], qt.Contains, "TestOpenPinnedCount")
+	qtc.Assert(pb.Close(), qt.IsNil)
+	qtc.Check(cache.OpenPinnedCount(), qt.Equals, 0)
+}
+
+func TestWriteBehind(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.WriteBehind.Set(squirrel.WriteBehindOpts{MaxBytes: 1 << 20})
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	other := squirrel.TestingNewCache(qtc, squirrel.NewCacheOpts{NewConnOpts: cacheOpts.NewConnOpts})
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	_, err = other.Get(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.Flush(), qt.IsNil)
+	value, err = other.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	// Listing keys includes buffered values.
+	qtc.Assert(cache.Put("buffered", defaultValue), qt.IsNil)
+	var keys []string
+	qtc.Assert(cache.IterKeys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"buffered", defaultKey})
+	// Close should flush pending values.
+	qtc.Assert(cache.Put("goodbye", defaultValue), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	value, err = other.ReadAll("goodbye", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	// Nothing would write values buffered after Close.
+	qtc.Check(cache.Put("late", defaultValue), qt.ErrorIs, squirrel.ErrClosed)
+}
+
+func TestCapabilities(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	version, err := cache.SQLiteVersion()
+	qtc.Assert(err, qt.IsNil)
+	caps, err := cache.Capabilities()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(caps.Version, qt.Equals, version)
+	qtc.Check(caps.Ok(), qt.IsTrue)
+}
+
+func TestSparseValue(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	err := cache.TxImmediate(func(tx *squirrel.Tx) error {
+		pb, err := tx.Create(defaultKey, squirrel.CreateOpts{Length: 14, Sparse: true})
+		qtc.Assert(err, qt.IsNil)
+		defer pb.Close()
+		n, err := pb.WriteAt([]byte("hello"), 7)
+		qtc.Check(n, qt.Equals, 5)
+		return err
+	})
+	qtc.Assert(err, qt.IsNil)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "\x00\x00\x00\x00\x00\x00\x00hello\x00\x00")
+	ranges, err := cache.PresentRanges(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ranges, qt.DeepEquals, []squirrel.Range{{Off: 4, Len: 8}})
+	cacheOpts.SparseReadsErr = true
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	_, err = cache.ReadAll(defaultKey, nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotPresent)
+	pb, err := cache.OpenPinnedReadOnly(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	defer pb.Close()
+	var buf [6]byte
+	n, err := pb.ReadAt(buf[:], 4)
+	qtc.Check(err, qt.IsNil)
+	qtc.Check(string(buf[:n]), qt.Equals, "\x00\x00\x00hel")
+}
+
+func TestPutMultiDuplicateKeys(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	items := []squirrel.PutItem{
+		{"a", []byte("first")},
+		{"b", []byte("only")},
+		{"a", []byte("last")},
+	}
+	check := func(key, value string) {
+		b, err := cache.ReadAll(key, nil)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(string(b), qt.Equals, value)
+	}
+	qtc.Assert(cache.PutMulti(items, squirrel.PutMultiOpts{}), qt.IsNil)
+	check("a", "last")
+	check("b", "only")
+	qtc.Assert(cache.PutMulti(items, squirrel.PutMultiOpts{
+		DuplicateKeys: squirrel.DuplicateKeysFirstWins,
+	}), qt.IsNil)
+	check("a", "first")
+	items[1].Value = []byte("changed")
+	err := cache.PutMulti(items, squirrel.PutMultiOpts{DuplicateKeys: squirrel.DuplicateKeysError})
+	qtc.Check(err, qt.ErrorAs, new(squirrel.ErrDuplicateKey))
+	// Nothing in the failed batch was stored.
+	check("b", "only")
+}
+
+func TestTrimFreeSpace(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Check(cache.TrimFreeSpace(0.1), qt.IsNotNil)
+	cacheOpts = squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetAutoVacuum = g.Some("incremental")
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, make([]byte, 1<<20)), qt.IsNil)
+	info, err := os.Stat(cacheOpts.Path)
+	qtc.Assert(err, qt.IsNil)
+	sizeBefore := info.Size()
+	qtc.Assert(cache.Tx(func(tx *squirrel.Tx) error {
+		return tx.Delete(defaultKey)
+	}), qt.IsNil)
+	qtc.Assert(cache.TrimFreeSpace(0.1), qt.IsNil)
+	info, err = os.Stat(cacheOpts.Path)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(info.Size() < sizeBefore/2, qt.IsTrue)
+}
+
+func TestJSON(t *testing.T) {
+	for _, mode := range []string{"plain", "compressed", "dedup"} {
+		t.Run(mode, func(t *testing.T) {
+			qtc := qt.New(t)
+			cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+			// Ensure values spanning several blobs are handled.
+			cacheOpts.MaxBlobSize.Set(8)
+			switch mode {
+			case "compressed":
+				cacheOpts.Compression = squirrel.CompressionFlate
+			case "dedup":
+				cacheOpts.Dedup = true
+			}
+			cache := squirrel.TestingNewCache(qtc, cacheOpts)
+			type config struct {
+				Name string
+				Port int
+			}
+			qtc.Assert(cache.PutJSON("a", config{"alpha", 1}), qt.IsNil)
+			qtc.Assert(cache.PutJSON("b", map[string]any{"Name": "beta"}), qt.IsNil)
+			qtc.Assert(cache.Put("c", []byte("not json")), qt.IsNil)
+			// Replacing a value with something else means it's no longer queried.
+			qtc.Assert(cache.PutJSON("d", config{"delta", 4}), qt.IsNil)
+			qtc.Assert(cache.Put("d", []byte(`{"Port":4}`)), qt.IsNil)
+			var got config
+			qtc.Assert(cache.GetJSON("a", &got), qt.IsNil)
+			qtc.Check(got, qt.Equals, config{"alpha", 1})
+			results := map[string]any{}
+			qtc.Assert(cache.QueryJSON("$.Port", func(key string, val any) error {
+				results[key] = val
+				return nil
+			}), qt.IsNil)
+			qtc.Check(results, qt.DeepEquals, map[string]any{"a": float64(1)})
+			results = map[string]any{}
+			qtc.Assert(cache.QueryJSON("$.Name", func(key string, val any) error {
+				results[key] = val
+				return nil
+			}), qt.IsNil)
+			qtc.Check(results, qt.DeepEquals, map[string]any{"a": "alpha", "b": "beta"})
+			// The values aren't marked with tags.
+			tags, err := cache.GetTags("a")
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(tags, qt.HasLen, 0)
+		})
+	}
+}
+
+func TestSoftHeapLimit(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SoftHeapLimit.Set(64 << 20)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	// Restore the default for the rest of the process.
+	cacheOpts.SoftHeapLimit.Set(0)
+	squirrel.TestingNewCache(qtc, cacheOpts)
+}
+
+func TestReplaceWith(t *testing.T) {
+	qtc := qt.New(t)
+	newOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	newCache := squirrel.TestingNewCache(qtc, newOpts)
+	qtc.Assert(newCache.Put(defaultKey, []byte("new")), qt.IsNil)
+	qtc.Assert(newCache.Close(), qt.IsNil)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, []byte("old")), qt.IsNil)
+	qtc.Check(cache.ReplaceWith(filepath.Join(t.TempDir(), "missing.db")), qt.IsNotNil)
+	qtc.Assert(cache.ReplaceWith(newOpts.Path), qt.IsNil)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "new")
+}
+
+func TestAccessHistogram(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for i, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		for range make([]struct{}, i*2) {
+			pb, err := cache.OpenPinnedReadOnly(key)
+			qtc.Assert(err, qt.IsNil)
+			_, err = pb.ReadAt(make([]byte, 1), 0)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Assert(pb.Close(), qt.IsNil)
+		}
+	}
+	buckets, err := cache.AccessHistogram()
+	qtc.Assert(err, qt.IsNil)
+	// Put counts as an access.
+	qtc.Check(buckets, qt.DeepEquals, []squirrel.AccessBucket{
+		{0, 0, 0, 0},
+		{1, 1, 1, 5},
+		{2, 3, 1, 5},
+		{4, 7, 1, 5},
+	})
+}
+
+func TestFrames(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	frames := []string{"hello", "", "world!"}
+	for _, frame := range frames {
+		qtc.Assert(cache.AppendFrame(defaultKey, []byte(frame)), qt.IsNil)
+	}
+	var got []string
+	qtc.Assert(cache.IterFrames(defaultKey, func(frame []byte) error {
+		got = append(got, string(frame))
+		return nil
+	}), qt.IsNil)
+	qtc.Check(got, qt.DeepEquals, frames)
+	// Small frames fill blobs, rather than each getting their own.
+	cacheOpts = squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cacheOpts.VerifyChecksums = true
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	for range [8]struct{}{} {
+		qtc.Assert(cache.AppendFrame(defaultKey, []byte("a")), qt.IsNil)
+	}
+	chunks, err := cache.ChunkCount(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(chunks, qt.Equals, 4)
+	b, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, bytes.Repeat([]byte{1, 'a'}, 8))
+}
+
+func TestMaxKeys(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 2
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	_, err := cache.ReadAll("a", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	for _, key := range []string{"b", "c"} {
+		_, err := cache.ReadAll(key, nil)
+		qtc.Check(err, qt.IsNil)
+	}
+}
+
+// Indexed values aren't keys, so MaxKeys neither counts nor evicts them, but they're evicted for
+// capacity and reported with their index.
+func TestMaxKeysIndexed(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 1
+	cacheOpts.CostFunc = func(key string, length int64) int64 {
+		return length
+	}
+	var now int64 = 1000
+	cacheOpts.TimeSource = func() int64 {
+		return now
+	}
+	var evicted, evictedIndexed []string
+	cacheOpts.OnEvict = func(key string, length int64) {
+		evicted = append(evicted, key)
+	}
+	cacheOpts.OnEvictIndexed = func(key string, index uint64, length int64) {
+		qtc.Check(length, qt.Equals, int64(3))
+		evictedIndexed = append(evictedIndexed, fmt.Sprintf("%v %v", key, index))
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.PutIndexed(defaultKey, 1, []byte("one")), qt.IsNil)
+	now = 2000
+	qtc.Assert(cache.PutIndexed(defaultKey, 2, []byte("two")), qt.IsNil)
+	now = 3000
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	now = 4000
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	qtc.Check(evicted, qt.DeepEquals, []string{"a"})
+	qtc.Check(evictedIndexed, qt.HasLen, 0)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(1))
+	var indices []uint64
+	qtc.Assert(cache.IterIndices(defaultKey, func(index uint64, length int64) bool {
+		indices = append(indices, index)
+		return true
+	}), qt.IsNil)
+	qtc.Check(indices, qt.DeepEquals, []uint64{1, 2})
+	values, freed, err := cache.TrimPreview(5)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(values, qt.DeepEquals, []squirrel.TrimPreviewValue{
+		{Key: defaultKey, Index: g.Some[uint64](1), Length: 3},
+		{Key: defaultKey, Index: g.Some[uint64](2), Length: 3},
+	})
+	qtc.Check(freed, qt.Equals, int64(6))
+	qtc.Assert(cache.SetCapacity(5), qt.IsNil)
+	qtc.Check(evictedIndexed, qt.DeepEquals, []string{defaultKey + " 1", defaultKey + " 2"})
+	qtc.Check(evicted, qt.DeepEquals, []string{"a"})
+	_, err = cache.GetIndexed(defaultKey, 1)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	_, err = cache.Get("b")
+	qtc.Check(err, qt.IsNil)
+}
+
+func TestValueHash(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", []byte("hello world")), qt.IsNil)
+	qtc.Assert(cache.Put("b", []byte("hello there")), qt.IsNil)
+	hashA, err := cache.ValueHash("a")
+	qtc.Assert(err, qt.IsNil)
+	hashB, err := cache.ValueHash("b")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(hashA, qt.Not(qt.DeepEquals), hashB)
+	// Update the part of b that differs, and check the stored blob hash is recomputed.
+	pb, err := cache.Create("b", squirrel.CreateOpts{Length: 11})
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.WriteAt([]byte("world"), 6)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	hashB, err = cache.ValueHash("b")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(hashB, qt.DeepEquals, hashA)
+	// Writes from another conn that hasn't seen any hashes stored still invalidate them.
+	other := squirrel.TestingNewCache(qtc, squirrel.NewCacheOpts{NewConnOpts: cacheOpts.NewConnOpts})
+	_, err = other.WriteAt("c", []byte("c"), 0)
+	qtc.Assert(err, qt.IsNil)
+	hashA, err = cache.ValueHash("a")
+	qtc.Assert(err, qt.IsNil)
+	_, err = other.WriteAt("a", []byte("y"), 0)
+	qtc.Assert(err, qt.IsNil)
+	hashA2, err := cache.ValueHash("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(hashA2, qt.Not(qt.DeepEquals), hashA)
+}
+
+func TestCloseOpts(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.CloseOpts(squirrel.CloseOpts{
+		Checkpoint: true,
+		Vacuum:     true,
+		Optimize:   true,
+	}), qt.IsNil)
+	_, err := cache.ReadAll(defaultKey, nil)
+	qtc.Check(err, qt.IsNotNil)
+	info, err := os.Stat(cacheOpts.Path + "-wal")
+	if err == nil {
+		qtc.Check(info.Size(), qt.Equals, int64(0))
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.OptimizeOnClose = true
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Check(cache.Optimize(), qt.IsNil)
+	qtc.Check(cache.Close(), qt.IsNil)
+	// Closing again doesn't try to optimize on a closed Cache.
+	qtc.Check(cache.Close(), qt.IsNil)
+}
+
+func TestJournalMode(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	mode, err := cache.JournalMode()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(mode, qt.Equals, "wal")
+}
+
+func TestDeleteMulti(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	deleted, err := cache.DeleteMulti([]string{"a", "c", "d", "a"})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(deleted, qt.Equals, 2)
+	_, err = cache.ReadAll("a", nil)
+	qtc.Check(err, qt.Equals, squirrel.ErrNotFound)
+	b, err := cache.ReadAll("b", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	_, err = cache.ReadAll("c", nil)
+	qtc.Check(err, qt.Equals, squirrel.ErrNotFound)
+}
+
+func TestCostFunc(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Capacity = 2500
+	cacheOpts.CostFunc = func(key string, length int64) int64 {
+		return 1000 + length
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	_, err := cache.ReadAll("a", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	for _, key := range []string{"b", "c"} {
+		_, err := cache.ReadAll(key, nil)
+		qtc.Check(err, qt.IsNil)
+	}
+}
+
+func TestWaitUnderCapacity(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 2
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qtc.Assert(cache.WaitUnderCapacity(ctx), qt.IsNil)
+}
+
+func TestReadMapped(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	_, _, err := cache.ReadMapped(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotMappable)
+
+	cacheOpts = squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MmapSizeOk = true
+	cacheOpts.MmapSize = 1 << 20
+	cacheOpts.MaxBlobSize.Set(4)
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", []byte("abc")), qt.IsNil)
+	qtc.Assert(cache.Put("b", []byte("abcdef")), qt.IsNil)
+	b, release, err := cache.ReadMapped("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "abc")
+	release()
+	// The transaction is finished, so the value can be replaced.
+	release()
+	qtc.Assert(cache.Put("a", []byte("xyz")), qt.IsNil)
+	b, release, err = cache.ReadMapped("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "xyz")
+	release()
+	_, _, err = cache.ReadMapped("b")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotMappable)
+	_, _, err = cache.ReadMapped("c")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestCorruptDatabase(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	qtc.Assert(os.WriteFile(cacheOpts.Path, bytes.Repeat([]byte("garbage!"), 1024), 0o644), qt.IsNil)
+	_, err := squirrel.NewCache(cacheOpts)
+	var corruptErr squirrel.ErrCorruptDatabase
+	qtc.Assert(errors.As(err, &corruptErr), qt.IsTrue, qt.Commentf("%v", err))
+	qtc.Check(corruptErr.Path, qt.Equals, cacheOpts.Path)
+	cacheOpts.RecreateOnCorrupt = true
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+}
+
+func TestContextCancelled(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	qtc.Check(cache.PutContext(ctx, defaultKey, defaultValue), qt.ErrorIs, context.Canceled)
+	_, err := cache.ReadAll(defaultKey, nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	// Cancel partway through a transaction.
+	ctx, cancel = context.WithCancel(context.Background())
+	err = cache.TxImmediateContext(ctx, func(tx *squirrel.Tx) error {
+		err := tx.Put(defaultKey, defaultValue)
+		if err != nil {
+			return err
+		}
+		cancel()
+		return tx.Put("b", defaultValue)
+	})
+	qtc.Check(err, qt.ErrorIs, context.Canceled)
+	_, err = cache.ReadAll(defaultKey, nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	// The interrupt doesn't affect later operations.
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	n, err := cache.ReadFullContext(context.Background(), defaultKey, make([]byte, len(defaultValue)))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(n, qt.Equals, len(defaultValue))
+}
+
+func TestNewReader(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	value := []byte("hello, streaming world")
+	qtc.Assert(cache.Put(defaultKey, value), qt.IsNil)
+	r, err := cache.NewReader(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	// Read in pieces that don't line up with the blobs.
+	var buf bytes.Buffer
+	_, err = io.CopyBuffer(&buf, struct{ io.Reader }{r}, make([]byte, 3))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(buf.Bytes(), qt.DeepEquals, value)
+	qtc.Check(r.Close(), qt.IsNil)
+	_, err = cache.NewReader("missing")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestNewWriter(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	w, err := cache.NewWriter(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	for _, s := range []string{"hel", "lo, stream", "ing", " world"} {
+		_, err = io.WriteString(w, s)
+		qtc.Assert(err, qt.IsNil)
+	}
+	qtc.Assert(w.Close(), qt.IsNil)
+	_, err = w.Write([]byte("more"))
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrClosed)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "hello, streaming world")
+	// Nothing written.
+	w, err = cache.NewWriter("empty")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(w.Close(), qt.IsNil)
+	b, err = cache.ReadAll("empty", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.HasLen, 0)
+}
+
+func TestPutWithTTL(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.PutWithTTL("a", defaultValue, time.Millisecond), qt.IsNil)
+	qtc.Assert(cache.PutWithTTL("b", defaultValue, time.Millisecond), qt.IsNil)
+	qtc.Assert(cache.PutWithTTL("c", defaultValue, time.Hour), qt.IsNil)
+	qtc.Assert(cache.Put("d", defaultValue), qt.IsNil)
+	time.Sleep(2 * time.Millisecond)
+	_, err := cache.ReadAll("a", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	evicted, err := cache.EvictExpired()
+	qtc.Assert(err, qt.IsNil)
+	// "a" was deleted when it was read.
+	qtc.Check(evicted, qt.Equals, 1)
+	// Both expired keys are gone from the database, not just hidden.
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(2))
+	evicted, err = cache.EvictExpired()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(evicted, qt.Equals, 0)
+	for _, key := range []string{"c", "d"} {
+		_, err = cache.ReadAll(key, nil)
+		qtc.Check(err, qt.IsNil)
+	}
+	// Putting again without a TTL removes the expiry.
+	qtc.Assert(cache.Put("c", defaultValue), qt.IsNil)
+}
+
+func TestIterKeys(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "ab/1", "ab/0", "ab\xff", "ac", "b"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	var keys []string
+	qtc.Assert(cache.IterKeys("ab", func(key string) bool {
+		keys = append(keys, key)
+		// The callback can use the Cache.
+		_, err := cache.ReadAll(key, nil)
+		qtc.Check(err, qt.IsNil)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"ab/0", "ab/1", "ab\xff"})
+	keys = nil
+	qtc.Assert(cache.IterKeys("", func(key string) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"a", "ab/0"})
+}
+
+func TestPutBatch(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	items := map[string][]byte{
+		"a": []byte("1"),
+		"b": []byte("22"),
+		"c": nil,
+	}
+	qtc.Assert(cache.PutBatch(items), qt.IsNil)
+	for key, value := range items {
+		b, err := cache.ReadAll(key, nil)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(b, qt.HasLen, len(value))
+		qtc.Check(string(b), qt.Equals, string(value))
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	problems, err := cache.IntegrityCheck()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.HasLen, 0)
+	problems, err = cache.QuickCheck()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.HasLen, 0)
+}
+
+func TestStats(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Capacity = 1 << 20
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", []byte("hello")), qt.IsNil)
+	qtc.Assert(cache.Put("b", []byte("hi")), qt.IsNil)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.ValueBytes, qt.Equals, int64(7))
+	qtc.Check(stats.Keys, qt.Equals, int64(2))
+	qtc.Check(stats.Capacity, qt.Equals, g.Some[int64](1<<20))
+	qtc.Check(stats.PageSize > 0, qt.IsTrue)
+	qtc.Check(stats.FileSize%stats.PageSize, qt.Equals, int64(0))
+	size, err := cache.KeySize("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(size, qt.Equals, int64(5))
+	_, err = cache.KeySize("c")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+// Content shared by deduplicated keys and indexed values aren't keys, and stored bytes are counted
+// once.
+func TestStatsDedup(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Dedup = true
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", []byte("hello")), qt.IsNil)
+	qtc.Assert(cache.Put("b", []byte("hello")), qt.IsNil)
+	qtc.Assert(cache.PutIndexed("c", 1, []byte("hi")), qt.IsNil)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(2))
+	qtc.Check(stats.ValueBytes, qt.Equals, int64(7))
+	_, used, _, err := cache.Capacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(used, qt.Equals, int64(7))
+	buckets, err := cache.AccessHistogram()
+	qtc.Assert(err, qt.IsNil)
+	var keys int64
+	for _, bucket := range buckets {
+		keys += bucket.Keys
+	}
+	qtc.Check(keys, qt.Equals, int64(2))
+	chunks, err := cache.ChunkCount("b")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(chunks, qt.Equals, 2)
+}
+
+func TestTypedTags(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 1
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTagInt(defaultKey, "piece", 42), qt.IsNil)
+	qtc.Assert(cache.SetTagBytes(defaultKey, "hash", []byte{0, 1, 2}), qt.IsNil)
+	value, ok, err := cache.GetTag(defaultKey, "piece")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(ok, qt.IsTrue)
+	qtc.Check(value.Int(), qt.Equals, int64(42))
+	qtc.Check(value.Text(), qt.Equals, "42")
+	value, ok, err = cache.GetTag(defaultKey, "hash")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(ok, qt.IsTrue)
+	qtc.Check(value.Bytes(), qt.DeepEquals, []byte{0, 1, 2})
+	_, ok, err = cache.GetTag(defaultKey, "missing")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ok, qt.IsFalse)
+	waitSqliteSubsec()
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	_, _, err = cache.GetTag(defaultKey, "piece")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for _, policy := range []struct {
+		name    string
+		policy  squirrel.EvictionPolicy
+		evicted string
+	}{
+		{"LRU", squirrel.EvictLRU, "a"},
+		{"LFU", squirrel.EvictLFU, "b"},
+	} {
+		t.Run(policy.name, func(t *testing.T) {
+			qtc := qt.New(t)
+			cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+			cacheOpts.MaxKeys = 2
+			cacheOpts.EvictionPolicy = policy.policy
+			cache := squirrel.TestingNewCache(qtc, cacheOpts)
+			// "a" is used often, but least recently.
+			qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+			for i := 0; i < 3; i++ {
+				pb, err := cache.OpenPinnedReadOnly("a")
+				qtc.Assert(err, qt.IsNil)
+				_, err = pb.ReadAt(make([]byte, 1), 0)
+				qtc.Assert(err, qt.IsNil)
+				qtc.Assert(pb.Close(), qt.IsNil)
+			}
+			waitSqliteSubsec()
+			qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+			waitSqliteSubsec()
+			qtc.Assert(cache.Put("c", defaultValue), qt.IsNil)
+			for _, key := range []string{"a", "b", "c"} {
+				_, err := cache.ReadAll(key, nil)
+				if key == policy.evicted {
+					qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+				} else {
+					qtc.Check(err, qt.IsNil)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimToCapacity(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.NoTriggers = true
+	cacheOpts.MaxKeys = 2
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	evicted, freed, err := cache.TrimToCapacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(evicted, qt.Equals, 0)
+	qtc.Check(freed, qt.Equals, int64(0))
+	// Trimming in a write transaction applies without triggers.
+	qtc.Assert(cache.Put("c", defaultValue), qt.IsNil)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(2))
+}
+
+func TestDelete(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"piece/1/0", "piece/1/1", "piece/10/0", "piece/2/0"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	qtc.Assert(cache.Delete("piece/2/0"), qt.IsNil)
+	_, err := cache.ReadAll("piece/2/0", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	// Deleting a missing key isn't an error.
+	qtc.Check(cache.Delete("piece/2/0"), qt.IsNil)
+	deleted, err := cache.DeletePrefix("piece/1/")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(deleted, qt.Equals, 2)
+	_, err = cache.ReadAll("piece/10/0", nil)
+	qtc.Check(err, qt.IsNil)
+}
+
+func TestReadOnly(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	readOnlyOpts := cacheOpts
+	readOnlyOpts.ReadOnly = true
+	_, err := squirrel.NewCache(readOnlyOpts)
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+	writer := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(writer.Put(defaultKey, defaultValue), qt.IsNil)
+	reader := squirrel.TestingNewCache(qtc, readOnlyOpts)
+	pb, err := reader.OpenPinnedReadOnly(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.ReadAt(make([]byte, 1), 0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	buckets, err := reader.AccessHistogram()
+	qtc.Assert(err, qt.IsNil)
+	// Only the Put was counted.
+	qtc.Check(buckets[1].Keys, qt.Equals, int64(1))
+	qtc.Check(reader.Put("b", defaultValue), qt.IsNotNil)
+	// Writes from elsewhere are still seen.
+	qtc.Assert(writer.Put("c", defaultValue), qt.IsNil)
+	_, err = reader.ReadAll("c", nil)
+	qtc.Check(err, qt.IsNil)
+}
+
+func TestBackup(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	backupPath := filepath.Join(qtc.TempDir(), "backup.db")
+	qtc.Assert(cache.BackupTo(backupPath), qt.IsNil)
+	var buf bytes.Buffer
+	qtc.Assert(cache.BackupToWriter(&buf), qt.IsNil)
+	writerPath := filepath.Join(qtc.TempDir(), "writer.db")
+	qtc.Assert(os.WriteFile(writerPath, buf.Bytes(), 0o644), qt.IsNil)
+	for _, path := range []string{backupPath, writerPath} {
+		backupOpts := squirrel.TestingDefaultCacheOpts(qtc)
+		backupOpts.Path = path
+		backup := squirrel.TestingNewCache(qtc, backupOpts)
+		value, err := backup.ReadAll(defaultKey, nil)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(value, qt.DeepEquals, defaultValue)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	qtc := qt.New(t)
+	for _, incremental := range []bool{false, true} {
+		cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+		if incremental {
+			cacheOpts.SetAutoVacuum = g.Some("incremental")
+		}
+		cache := squirrel.TestingNewCache(qtc, cacheOpts)
+		qtc.Assert(cache.Put(defaultKey, make([]byte, 1<<20)), qt.IsNil)
+		info, err := os.Stat(cacheOpts.Path)
+		qtc.Assert(err, qt.IsNil)
+		sizeBefore := info.Size()
+		qtc.Assert(cache.Delete(defaultKey), qt.IsNil)
+		if incremental {
+			qtc.Assert(cache.IncrementalVacuum(0), qt.IsNil)
+		} else {
+			qtc.Assert(cache.Vacuum(), qt.IsNil)
+		}
+		info, err = os.Stat(cacheOpts.Path)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(info.Size() < sizeBefore/2, qt.IsTrue, qt.Commentf("incremental: %v", incremental))
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "delete"
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	_, _, _, err := cache.Checkpoint(squirrel.CheckpointPassive)
+	qtc.Check(err, qt.IsNotNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.SetJournalMode = "wal"
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	busy, walFrames, checkpointed, err := cache.Checkpoint(squirrel.CheckpointTruncate)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(busy, qt.Equals, 0)
+	// Truncating empties the WAL.
+	qtc.Check(walFrames, qt.Equals, 0)
+	qtc.Check(checkpointed, qt.Equals, 0)
+	info, err := os.Stat(cacheOpts.Path + "-wal")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(info.Size(), qt.Equals, int64(0))
+}
+
+func TestMaxBlobSize(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	for _, size := range []int64{0, -1, 1 << 40} {
+		cacheOpts.MaxBlobSize.Set(size)
+		_, err := squirrel.NewCache(cacheOpts)
+		qtc.Check(err, qt.IsNotNil)
+	}
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, []byte("hello world")), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	// Values written with another max blob size remain readable and writable.
+	cacheOpts.MaxBlobSize.Set(7)
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "hello world")
+	pb, err := cache.Create(defaultKey, squirrel.CreateOpts{Length: int64(len(value))})
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.WriteAt([]byte("W0"), 6)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	value, err = cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "hello W0rld")
+}
+
+func TestExists(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	for i := 0; i < 2; i++ {
+		exists, err := cache.Exists(defaultKey)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(exists, qt.IsTrue)
+	}
+	exists, err := cache.Exists("missing")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(exists, qt.IsFalse)
+	// Only the Put counted as an access.
+	buckets, err := cache.AccessHistogram()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(buckets[1].Keys, qt.Equals, int64(1))
+}
+
+func TestReadFullShortValue(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	b := make([]byte, len(defaultValue)+1)
+	n, err := cache.ReadFull(defaultKey, b)
+	qtc.Check(n, qt.Equals, len(defaultValue))
+	qtc.Check(err, qt.ErrorIs, io.ErrUnexpectedEOF)
+	var shortErr squirrel.ErrShortValue
+	qtc.Assert(errors.As(err, &shortErr), qt.IsTrue)
+	qtc.Check(shortErr, qt.Equals, squirrel.ErrShortValue{
+		Key:  defaultKey,
+		Have: int64(len(defaultValue)),
+		Want: int64(len(b)),
+	})
+	_, err = cache.ReadFull("missing", b)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestGet(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.Put("empty", nil), qt.IsNil)
+	b, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	b, err = cache.Get("empty")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.IsNotNil)
+	qtc.Check(b, qt.HasLen, 0)
+	_, err = cache.Get("missing")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	buckets, err := cache.AccessHistogram()
+	qtc.Assert(err, qt.IsNil)
+	// The Get counted as an access for defaultKey, on top of its Put.
+	qtc.Check(buckets[2].Keys, qt.Equals, int64(1))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	swap := func(old, new string, expected bool) {
+		var oldBytes []byte
+		if old != "" {
+			oldBytes = []byte(old)
+		}
+		swapped, err := cache.CompareAndSwap(defaultKey, oldBytes, []byte(new))
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(swapped, qt.Equals, expected, qt.Commentf("%q -> %q", old, new))
+	}
+	swap("hello", "world", false)
+	swap("", "hello", true)
+	swap("", "world", false)
+	swap("world", "there", false)
+	swap("hello", "there", true)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "there")
+}
+
+func TestRename(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTag("a", "verified", true), qt.IsNil)
+	qtc.Check(cache.Rename("a", "b"), qt.ErrorAs, new(squirrel.ErrKeyExists))
+	qtc.Check(cache.Rename("missing", "c"), qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.Rename("a", "c"), qt.IsNil)
+	_, err := cache.ReadAll("a", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	b, err := cache.ReadAll("c", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	_, ok, err := cache.GetTag("c", "verified")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ok, qt.IsTrue)
+}
+
+func TestChunkCount(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	chunks, err := cache.ChunkCount(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(chunks, qt.Equals, 3)
+	_, err = cache.ChunkCount("missing")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestCompression(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Compression = squirrel.CompressionFlate
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	qtc.Assert(cache.Put("compressed", value), qt.IsNil)
+	// Too short to benefit, so it's stored as is.
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	b, err := cache.ReadAll("compressed", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	size, err := cache.KeySize("compressed")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(size, qt.Equals, int64(len(value)))
+	_, err = cache.ReadFull("compressed", make([]byte, len(value)+1))
+	qtc.Check(err, qt.ErrorAs, new(squirrel.ErrShortValue))
+	r, err := cache.NewReader("compressed")
+	qtc.Assert(err, qt.IsNil)
+	b, err = io.ReadAll(r)
+	qtc.Check(r.Close(), qt.IsNil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	_, err = cache.OpenPinnedReadOnly("compressed")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrCompressed)
+	qtc.Check(cache.AppendFrame("compressed", nil), qt.ErrorIs, squirrel.ErrCompressed)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.ValueBytes < int64(len(value)), qt.IsTrue)
+	// Caches without compression can read compressed values.
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.Compression = squirrel.CompressionNone
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	b, err = cache.Get("compressed")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	b, err = cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+}
+
+// Not secure: prefixes a marker and flips the bits, so ciphertext is longer than plaintext.
+type testCrypter struct{}
+
+func (testCrypter) Encrypt(plain []byte) []byte {
+	cipher := []byte{'!'}
+	for _, b := range plain {
+		cipher = append(cipher, ^b)
+	}
+	return cipher
+}
+
+func (testCrypter) Decrypt(cipher []byte) ([]byte, error) {
+	if len(cipher) == 0 || cipher[0] != '!' {
+		return nil, errors.New("bad ciphertext")
+	}
+	plain := make([]byte, 0, len(cipher)-1)
+	for _, b := range cipher[1:] {
+		plain = append(plain, ^b)
+	}
+	return plain, nil
+}
+
+func TestBlobCrypter(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.BlobCrypter = testCrypter{}
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	chunks, err := cache.ChunkCount(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(chunks, qt.Equals, 3)
+	_, err = cache.OpenPinnedReadOnly(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrEncrypted)
+	// Compression applies before encryption.
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.Compression = squirrel.CompressionFlate
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	value := bytes.Repeat([]byte("compressible "), 100)
+	qtc.Assert(cache.Put("compressed", value), qt.IsNil)
+	b, err = cache.Get("compressed")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	// Encrypted values can't be read without the crypter.
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.BlobCrypter = nil
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	_, err = cache.Get(defaultKey)
+	qtc.Check(err, qt.IsNotNil)
+}
+
+func TestFS(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put("a/b", []byte("ab")), qt.IsNil)
+	qtc.Assert(cache.Put("a/c/d", []byte("acd")), qt.IsNil)
+	qtc.Assert(cache.Put("e", []byte("e")), qt.IsNil)
+	fsys := cache.FS()
+	qtc.Check(fstest.TestFS(fsys, "a/b", "a/c/d", "e"), qt.IsNil)
+	b, err := fs.ReadFile(fsys, "a/c/d")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "acd")
+	info, err := fs.Stat(fsys, "a/b")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(info.Size(), qt.Equals, int64(2))
+	qtc.Check(info.ModTime().IsZero(), qt.IsFalse)
+	_, err = fsys.Open("a/missing")
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+	// Buffered values are visible, and expired ones that haven't been deleted aren't.
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.WriteBehind.Set(squirrel.WriteBehindOpts{})
+	var now int64 = 1000
+	cacheOpts.TimeSource = func() int64 {
+		return now
+	}
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.PutWithTTL("x/expired", defaultValue, time.Second), qt.IsNil)
+	now = 2000
+	qtc.Assert(cache.Put("x/buffered", defaultValue), qt.IsNil)
+	entries, err := fs.ReadDir(cache.FS(), "x")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(entries, qt.HasLen, 1)
+	qtc.Check(entries[0].Name(), qt.Equals, "buffered")
+}
+
+func TestOpenPinnedWritable(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	pb, err := cache.OpenPinnedWritable(defaultKey, 8)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(pb.Length(), qt.Equals, int64(8))
+	_, err = pb.WriteAt([]byte("!!!"), 4)
+	qtc.Check(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "worl!!!\x00")
+	// Doesn't shrink.
+	pb, err = cache.OpenPinnedWritable(defaultKey, 1)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(pb.Length(), qt.Equals, int64(8))
+	qtc.Assert(pb.Close(), qt.IsNil)
+	pb, err = cache.OpenPinnedWritable("new", 3)
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.WriteAt([]byte("new"), 0)
+	qtc.Check(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	b, err = cache.ReadAll("new", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "new")
+}
+
+func TestPinnedBlobConcurrentIo(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	pb, err := cache.Create(defaultKey, squirrel.CreateOpts{Length: 64})
+	qtc.Assert(err, qt.IsNil)
+	var eg errgroup.Group
+	for i := 0; i < 8; i++ {
+		off := int64(i * 8)
+		eg.Go(func() error {
+			_, err := pb.WriteAt(bytes.Repeat([]byte{byte(off)}, 8), off)
+			if err != nil {
+				return err
+			}
+			_, err = pb.ReadAt(make([]byte, 8), off)
+			return err
+		})
+	}
+	qtc.Check(eg.Wait(), qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	for i := range b {
+		qtc.Check(b[i], qt.Equals, byte(i/8*8))
+	}
+}
+
+// PinnedBlobs from the same Tx share its conn, so they must be safe to use concurrently with each
+// other. Run with -race.
+func TestPinnedBlobsInTxConcurrentIo(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(4)
+	cacheOpts.VerifyChecksums = true
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	keys := []string{"a", "b"}
+	qtc.Assert(cache.Tx(func(tx *squirrel.Tx) error {
+		var eg errgroup.Group
+		for _, key := range keys {
+			pb, err := tx.Create(key, squirrel.CreateOpts{Length: 64})
+			if err != nil {
+				return err
+			}
+			defer pb.Close()
+			for i := 0; i < 8; i++ {
+				off := int64(i * 8)
+				eg.Go(func() error {
+					_, err := pb.WriteAt(bytes.Repeat([]byte{byte(off)}, 8), off)
+					if err != nil {
+						return err
+					}
+					_, err = pb.ReadAt(make([]byte, 8), off)
+					if err != nil {
+						return err
+					}
+					_, err = pb.LengthErr()
+					return err
+				})
+			}
+		}
+		return eg.Wait()
+	}), qt.IsNil)
+	for _, key := range keys {
+		b, err := cache.ReadAll(key, nil)
+		qtc.Assert(err, qt.IsNil)
+		for i := range b {
+			qtc.Check(b[i], qt.Equals, byte(i/8*8))
+		}
+	}
+}
+
+func TestIndexed(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.PutIndexed(defaultKey, 2, []byte("two")), qt.IsNil)
+	qtc.Assert(cache.PutIndexed(defaultKey, 1, []byte("one")), qt.IsNil)
+	qtc.Assert(cache.PutIndexed(defaultKey, 1, []byte("uno")), qt.IsNil)
+	qtc.Assert(cache.PutIndexed("other", 1, nil), qt.IsNil)
+	b, err := cache.GetIndexed(defaultKey, 1)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "uno")
+	b, err = cache.GetIndexed("other", 1)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.HasLen, 0)
+	_, err = cache.GetIndexed(defaultKey, 3)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	var indices []uint64
+	qtc.Assert(cache.IterIndices(defaultKey, func(index uint64, length int64) bool {
+		qtc.Check(length, qt.Equals, int64(3))
+		indices = append(indices, index)
+		return true
+	}), qt.IsNil)
+	qtc.Check(indices, qt.DeepEquals, []uint64{1, 2})
+	// The key's own value is separate.
+	b, err = cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	var keys []string
+	qtc.Assert(cache.IterKeys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{defaultKey})
+	qtc.Assert(cache.DeleteIndexed(defaultKey, 2), qt.IsNil)
+	qtc.Check(cache.DeleteIndexed(defaultKey, 2), qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Check(cache.PutIndexed(defaultKey, 1<<63, nil), qt.IsNotNil)
+}
+
+func TestReadRanges(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(3)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, []byte("0123456789")), qt.IsNil)
+	blob := cache.NewBlobRef(defaultKey)
+	dst := make([]byte, 6)
+	qtc.Assert(blob.ReadRanges([]squirrel.Range{{1, 1}, {2, 3}, {8, 2}}, dst), qt.IsNil)
+	qtc.Check(string(dst), qt.Equals, "123489")
+	qtc.Check(blob.ReadRanges([]squirrel.Range{{2, 2}, {1, 1}}, dst), qt.IsNotNil)
+	qtc.Check(blob.ReadRanges([]squirrel.Range{{8, 3}}, dst), qt.IsNotNil)
+	// Unwritten regions of sparse values read as zeroes.
+	pb, err := cache.Create("sparse", squirrel.CreateOpts{Length: 10, Sparse: true})
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.WriteAt([]byte("x"), 7)
+	qtc.Check(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	qtc.Assert(cache.NewBlobRef("sparse").ReadRanges([]squirrel.Range{{6, 3}}, dst), qt.IsNil)
+	qtc.Check(string(dst[:3]), qt.Equals, "\x00x\x00")
+}
+
+func TestMaxConns(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxConns = 2
+	cacheOpts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	// Concurrent readers each get a conn.
+	pb1, err := cache.OpenPinnedReadOnly(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	pb2, err := cache.OpenPinnedReadOnly(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	read := make(chan error)
+	go func() {
+		_, err := cache.ReadAll(defaultKey, nil)
+		read <- err
+	}()
+	select {
+	case <-read:
+		t.Fatal("read with all conns pinned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	qtc.Assert(pb1.Close(), qt.IsNil)
+	qtc.Check(<-read, qt.IsNil)
+	qtc.Assert(pb2.Close(), qt.IsNil)
+}
+
+func TestSync(t *testing.T) {
+	for _, journalMode := range []string{"wal", "delete"} {
+		t.Run(journalMode, func(t *testing.T) {
+			qtc := qt.New(t)
+			cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+			cacheOpts.SetJournalMode = journalMode
+			cacheOpts.SetSynchronous = squirrel.SynchronousOff
+			cache := squirrel.TestingNewCache(qtc, cacheOpts)
+			qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+			qtc.Assert(cache.Sync(), qt.IsNil)
+			if journalMode == "wal" {
+				// The WAL was fully checkpointed.
+				_, log, checkpointed, err := cache.Checkpoint(squirrel.CheckpointPassive)
+				qtc.Assert(err, qt.IsNil)
+				qtc.Check(checkpointed, qt.Equals, log)
+			}
+		})
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 1
+	var cache *squirrel.Cache
+	var evicted []string
+	cacheOpts.OnEvict = func(key string, length int64) {
+		qtc.Check(length, qt.Equals, int64(len(defaultValue)))
+		// The Cache can be used from the callback.
+		_, err := cache.Get(key)
+		qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+		evicted = append(evicted, key)
+	}
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	waitSqliteSubsec()
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	waitSqliteSubsec()
+	qtc.Assert(cache.Put("c", defaultValue), qt.IsNil)
+	qtc.Check(evicted, qt.DeepEquals, []string{"a", "b"})
+}
+
+func TestTrimPreview(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.CostFunc = func(key string, length int64) int64 {
+		return length
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	values, freed, err := cache.TrimPreview(6)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(values, qt.DeepEquals, []squirrel.TrimPreviewValue{
+		{Key: "a", Length: 5},
+		{Key: "b", Length: 5},
+	})
+	qtc.Check(freed, qt.Equals, int64(10))
+	values, freed, err = cache.TrimPreview(15)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(values, qt.HasLen, 0)
+	qtc.Check(freed, qt.Equals, int64(0))
+	// Nothing was deleted.
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(3))
+}
+
+type testObserver struct {
+	events []string
+}
+
+func (o *testObserver) OnHit(key string) {
+	o.events = append(o.events, "hit "+key)
+}
+
+func (o *testObserver) OnMiss(key string) {
+	o.events = append(o.events, "miss "+key)
+}
+
+func (o *testObserver) OnPut(key string, n int) {
+	o.events = append(o.events, fmt.Sprintf("put %v %v", key, n))
+}
+
+func (o *testObserver) OnEvict(key string, length int64) {
+	o.events = append(o.events, fmt.Sprintf("evict %v %v", key, length))
+}
+
+func (o *testObserver) OnBusyRetry() {
+	o.events = append(o.events, "busy retry")
+}
+
+func TestObserver(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxKeys = 1
+	var observer testObserver
+	cacheOpts.Observer = &observer
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	_, err := cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	_, err = cache.ReadAll("b", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	waitSqliteSubsec()
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	_, err = cache.ReadFull("b", make([]byte, 1))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(observer.events, qt.DeepEquals, []string{
+		"put a 5",
+		"hit a",
+		"miss b",
+		// Eviction happens in the transaction that puts b.
+		"evict a 5",
+		"put b 5",
+		"hit b",
+	})
+}
+
+func TestBusyTimeout(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	holder := squirrel.TestingNewCache(qtc, cacheOpts)
+	cacheOpts.BusyTimeout = 50 * time.Millisecond
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	// Holds a write transaction until it's closed.
+	pb, err := holder.Create("held", squirrel.CreateOpts{Length: 1})
+	qtc.Assert(err, qt.IsNil)
+	err = cache.Put(defaultKey, defaultValue)
+	qtc.Check(sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeBusy), qt.IsTrue, qt.Commentf("%v", err))
+	// The lock is released before the timeout.
+	time.AfterFunc(10*time.Millisecond, func() { pb.Close() })
+	qtc.Check(cache.Put(defaultKey, defaultValue), qt.IsNil)
+}
+
+// Transactions that fail with busy after effects outside the Tx, like pinning a blob or consuming a
+// reader, aren't run again.
+func TestBusyNotRetriedAfterEffects(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	reader := squirrel.TestingNewCache(qtc, cacheOpts)
+	cacheOpts.BusyTimeout = 50 * time.Millisecond
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	// A read transaction on another conn prevents commits in the default journal mode.
+	holdRead := func() (release func()) {
+		started := make(chan struct{})
+		released := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reader.Tx(func(tx *squirrel.Tx) error {
+				_, err := tx.Get(defaultKey)
+				close(started)
+				<-released
+				return err
+			})
+		}()
+		<-started
+		return func() {
+			close(released)
+			<-done
+		}
+	}
+	checkBusy := func(err error) {
+		qtc.Helper()
+		qtc.Check(sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeBusy), qt.IsTrue, qt.Commentf("%v", err))
+	}
+	pb, err := cache.OpenPinnedWritable(defaultKey, 0)
+	qtc.Assert(err, qt.IsNil)
+	_, err = pb.WriteAt([]byte("W"), 0)
+	qtc.Assert(err, qt.IsNil)
+	release := holdRead()
+	// The commit fails, and is reported instead of pinning the blob again.
+	checkBusy(pb.Close())
+	release()
+	b, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+	release = holdRead()
+	reads := 0
+	r := readerFunc(func(b []byte) (int, error) {
+		reads++
+		return copy(b, "hello"), nil
+	})
+	_, err = cache.PutReader(defaultKey, r, 5)
+	checkBusy(err)
+	qtc.Check(reads, qt.Equals, 1)
+	release()
+}
+
+type readerFunc func(b []byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestIterByLastUsed(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	// Indexed values have no key of their own, and aren't visited even though they're oldest.
+	qtc.Assert(cache.PutIndexed("a", 1, defaultValue), qt.IsNil)
+	waitSqliteSubsec()
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	_, err := cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	var keys []string
+	var prev time.Time
+	qtc.Assert(cache.IterByLastUsed(0, func(key string, lastUsed time.Time, accessCount int64) bool {
+		qtc.Check(lastUsed.Before(prev), qt.IsFalse)
+		prev = lastUsed
+		keys = append(keys, key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"b", "c", "a"})
+	keys = nil
+	qtc.Assert(cache.IterByLastUsed(1, func(key string, lastUsed time.Time, accessCount int64) bool {
+		keys = append(keys, key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"b"})
+}
+
+func TestPutReader(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(3)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	value := []byte("hello, world")
+	written, err := cache.PutReader(defaultKey, bytes.NewReader(value), int64(len(value)))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(written, qt.Equals, int64(len(value)))
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	// Too short, so the existing value is kept.
+	_, err = cache.PutReader(defaultKey, strings.NewReader("short"), 10)
+	qtc.Check(err, qt.ErrorIs, io.ErrUnexpectedEOF)
+	b, err = cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	_, err = cache.PutReader(defaultKey, strings.NewReader("short"), -1)
+	qtc.Check(err, qt.IsNotNil)
+}
+
+func TestCacheReadAt(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	b := make([]byte, 3)
+	n, err := cache.ReadAt(defaultKey, b, 1)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b[:n]), qt.Equals, "orl")
+	n, err = cache.ReadAt(defaultKey, b, 3)
+	qtc.Check(err, qt.Equals, io.EOF)
+	qtc.Check(string(b[:n]), qt.Equals, "ld")
+	_, err = cache.ReadAt("missing", b, 0)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	n, err = cache.ReadAt(defaultKey, b, -1)
+	qtc.Check(err, qt.IsNotNil)
+	qtc.Check(n, qt.Equals, 0)
+	// Compressed values are read in full, and then sliced.
+	cacheOpts = squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Compression = squirrel.CompressionFlate
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	_, err = cache.ReadAt(defaultKey, b, -1)
+	qtc.Check(err, qt.IsNotNil)
+}
+
+func TestCacheWriteAt(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	n, err := cache.WriteAt(defaultKey, []byte("lo"), 3)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(n, qt.Equals, 2)
+	_, err = cache.WriteAt(defaultKey, []byte("hel"), 0)
+	qtc.Assert(err, qt.IsNil)
+	_, err = cache.WriteAt(defaultKey, []byte("!"), 5)
+	qtc.Assert(err, qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "hello!")
+}
+
+func TestSetCapacity(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Capacity = 1 << 20
+	cacheOpts.CostFunc = func(key string, length int64) int64 {
+		return length
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	qtc.Assert(cache.SetCapacity(6), qt.IsNil)
+	capacity, ok := cache.GetCapacity()
+	qtc.Check(ok, qt.IsTrue)
+	qtc.Check(capacity, qt.Equals, int64(6))
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(1))
+	qtc.Assert(cache.SetCapacity(-1), qt.IsNil)
+	_, ok = cache.GetCapacity()
+	qtc.Check(ok, qt.IsFalse)
+	// Zero restores the capacity the Cache was opened with.
+	qtc.Assert(cache.SetCapacity(0), qt.IsNil)
+	capacity, ok = cache.GetCapacity()
+	qtc.Check(ok, qt.IsTrue)
+	qtc.Check(capacity, qt.Equals, cacheOpts.Capacity)
+}
+
+func TestCapacity(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	_, used, unlimited, err := cache.Capacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(unlimited, qt.IsTrue)
+	qtc.Check(used, qt.Equals, int64(2*len(defaultValue)))
+	qtc.Assert(cache.SetCapacity(1<<20), qt.IsNil)
+	limit, used, unlimited, err := cache.Capacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(unlimited, qt.IsFalse)
+	qtc.Check(limit, qt.Equals, int64(1<<20))
+	qtc.Check(used, qt.Equals, int64(2*len(defaultValue)))
+}
+
+func TestMemoryNameShared(t *testing.T) {
+	qtc := qt.New(t)
+	var opts squirrel.NewCacheOpts
+	opts.MemoryName = t.Name()
+	a := squirrel.TestingNewCache(qtc, opts)
+	b := squirrel.TestingNewCache(qtc, opts)
+	qtc.Assert(a.Put(defaultKey, defaultValue), qt.IsNil)
+	value, err := b.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	opts.MemoryName = t.Name() + "-other"
+	other := squirrel.TestingNewCache(qtc, opts)
+	_, err = other.Get(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestTouch(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "b"} {
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		waitSqliteSubsec()
+	}
+	qtc.Assert(cache.Touch("a"), qt.IsNil)
+	qtc.Check(cache.Touch("c"), qt.ErrorIs, squirrel.ErrNotFound)
+	var keys []string
+	accessCounts := make(map[string]int64)
+	qtc.Assert(cache.IterByLastUsed(0, func(key string, lastUsed time.Time, accessCount int64) bool {
+		keys = append(keys, key)
+		accessCounts[key] = accessCount
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"b", "a"})
+	qtc.Check(accessCounts["a"], qt.Equals, accessCounts["b"]+1)
+}
+
+func TestNewCacheFromConn(t *testing.T) {
+	qtc := qt.New(t)
+	path := squirrel.TestingTempCachePath(t)
+	conn, err := sqlite.OpenConn(path, 0)
+	qtc.Assert(err, qt.IsNil)
+	defer conn.Close()
+	qtc.Assert(sqlitex.ExecScript(conn, "create table app (name text); insert into app values ('a');"), qt.IsNil)
+	var opts squirrel.NewCacheOpts
+	opts.TablePrefix = "squirrel_"
+	cache, err := squirrel.NewCacheFromConn(conn, opts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	value, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	// The conn is still usable, and has both the application's and squirrel's tables.
+	var rows []int64
+	qtc.Assert(sqlitex.Exec(
+		conn,
+		"select (select count(*) from app), (select count(*) from squirrel_keys)",
+		func(stmt *sqlite.Stmt) error {
+			rows = append(rows, stmt.ColumnInt64(0), stmt.ColumnInt64(1))
+			return nil
+		},
+	), qt.IsNil)
+	qtc.Check(rows, qt.DeepEquals, []int64{1, 1})
+}
+
+func TestTablePrefixIsolation(t *testing.T) {
+	qtc := qt.New(t)
+	path := squirrel.TestingTempCachePath(t)
+	newCache := func(prefix string) *squirrel.Cache {
+		var opts squirrel.NewCacheOpts
+		opts.Path = path
+		opts.TablePrefix = prefix
+		return squirrel.TestingNewCache(qtc, opts)
+	}
+	a := newCache("a_")
+	b := newCache("b_")
+	qtc.Assert(a.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(b.Put(defaultKey, []byte("other")), qt.IsNil)
+	qtc.Assert(b.Put("b only", nil), qt.IsNil)
+	value, err := a.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	_, err = a.Get("b only")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(b.Delete(defaultKey), qt.IsNil)
+	_, err = a.Get(defaultKey)
+	qtc.Check(err, qt.IsNil)
+	var opts squirrel.NewCacheOpts
+	opts.Path = path
+	opts.TablePrefix = "bad prefix"
+	_, err = squirrel.NewCache(opts)
+	qtc.Check(err, qt.ErrorMatches, `invalid table prefix .*`)
+}
+
+func TestClear(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(2)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.SetCapacity(1<<20), qt.IsNil)
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	qtc.Assert(cache.Put("b", defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTag("a", "tag", 1), qt.IsNil)
+	qtc.Assert(cache.Clear(), qt.IsNil)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(0))
+	qtc.Check(stats.ValueBytes, qt.Equals, int64(0))
+	_, err = cache.Get("a")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	capacity, ok := cache.GetCapacity()
+	qtc.Check(ok, qt.IsTrue)
+	qtc.Check(capacity, qt.Equals, int64(1<<20))
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	value, err := cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+}
+
+func TestSavepoint(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	errSpeculative := errors.New("speculative")
+	qtc.Assert(cache.TxImmediate(func(tx *squirrel.Tx) error {
+		err := tx.Put("a", defaultValue)
+		if err != nil {
+			return err
+		}
+		err = tx.Savepoint("outer", func() error {
+			err := tx.Put("b", defaultValue)
+			if err != nil {
+				return err
+			}
+			err = tx.Savepoint("inner", func() error {
+				err := tx.Put("c", defaultValue)
+				if err != nil {
+					return err
+				}
+				return errSpeculative
+			})
+			qtc.Check(err, qt.ErrorIs, errSpeculative)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Savepoint("outer", func() error {
+			err := tx.Delete("a")
+			if err != nil {
+				return err
+			}
+			return errSpeculative
+		})
+	}), qt.ErrorIs, errSpeculative)
+	// The transaction failed as a whole.
+	_, err := cache.Get("a")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.TxImmediate(func(tx *squirrel.Tx) error {
+		err := tx.Put("a", defaultValue)
+		if err != nil {
+			return err
+		}
+		err = tx.Savepoint("delete", func() error {
+			err := tx.Delete("a")
+			if err != nil {
+				return err
+			}
+			return tx.Savepoint("put", func() error {
+				return tx.Put("b", defaultValue)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Savepoint("undone", func() error {
+			err := tx.Put("c", defaultValue)
+			if err != nil {
+				return err
+			}
+			return errSpeculative
+		})
+		qtc.Check(err, qt.ErrorIs, errSpeculative)
+		return nil
+	}), qt.IsNil)
+	for key, present := range map[string]bool{"a": false, "b": true, "c": false} {
+		_, err := cache.Get(key)
+		if present {
+			qtc.Check(err, qt.IsNil, qt.Commentf(key))
+		} else {
+			qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound, qt.Commentf(key))
+		}
+	}
+}
+
+func TestWrittenRanges(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	blob := cache.BlobWithLength("piece", 10)
+	checkWritten := func(want []squirrel.Range, wantComplete bool) {
+		qtc.Helper()
+		ranges, err := blob.WrittenRanges()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(ranges, qt.DeepEquals, want)
+		complete, err := blob.IsComplete()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(complete, qt.Equals, wantComplete)
+	}
+	_, err := blob.WriteAt([]byte("ab"), 2)
+	qtc.Assert(err, qt.IsNil)
+	checkWritten([]squirrel.Range{{Off: 2, Len: 2}}, false)
+	_, err = blob.WriteAt([]byte("cd"), 6)
+	qtc.Assert(err, qt.IsNil)
+	checkWritten([]squirrel.Range{{Off: 2, Len: 2}, {Off: 6, Len: 2}}, false)
+	// Adjacent and overlapping writes are merged.
+	_, err = blob.WriteAt([]byte("efg"), 3)
+	qtc.Assert(err, qt.IsNil)
+	checkWritten([]squirrel.Range{{Off: 2, Len: 6}}, false)
+	_, err = blob.WriteAt([]byte("hi"), 0)
+	qtc.Assert(err, qt.IsNil)
+	_, err = blob.WriteAt([]byte("jk"), 8)
+	qtc.Assert(err, qt.IsNil)
+	checkWritten([]squirrel.Range{{Off: 0, Len: 10}}, true)
+	// Values written in full aren't tracked.
+	qtc.Assert(cache.Put("piece", defaultValue), qt.IsNil)
+	checkWritten([]squirrel.Range{{Off: 0, Len: int64(len(defaultValue))}}, true)
+}
+
+func TestGetTags(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	tags, err := cache.GetTags(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.HasLen, 0)
+	qtc.Assert(cache.SetTagInt(defaultKey, "piece", 42), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "verified", true), qt.IsNil)
+	qtc.Assert(cache.SetTagBytes(defaultKey, "hash", []byte{0, 1, 2}), qt.IsNil)
+	tags, err = cache.GetTags(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.HasLen, 3)
+	qtc.Check(tags["piece"].Int(), qt.Equals, int64(42))
+	qtc.Check(tags["verified"].Int(), qt.Equals, int64(1))
+	qtc.Check(tags["hash"].Bytes(), qt.DeepEquals, []byte{0, 1, 2})
+	_, err = cache.GetTags("missing")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestDeleteTag(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "verified", true), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "piece", 1), qt.IsNil)
+	getAccessCount := func() (accessCount int64) {
+		qtc.Assert(cache.IterByLastUsed(0, func(key string, lastUsed time.Time, count int64) bool {
+			accessCount = count
+			return true
+		}), qt.IsNil)
+		return accessCount
+	}
+	before := getAccessCount()
+	qtc.Assert(cache.DeleteTag(defaultKey, "verified"), qt.IsNil)
+	qtc.Assert(cache.DeleteTag(defaultKey, "verified"), qt.IsNil)
+	qtc.Assert(cache.DeleteTag("missing", "verified"), qt.IsNil)
+	tags, err := cache.GetTags(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.HasLen, 1)
+	qtc.Check(tags["piece"].Int(), qt.Equals, int64(1))
+	qtc.Check(getAccessCount(), qt.Equals, before)
+	value, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+}
+
+func TestKeysWithTag(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for i, verified := range []bool{true, false, true, true} {
+		key := fmt.Sprintf("chunk%d", i)
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+		qtc.Assert(cache.SetTag(key, "verified", verified), qt.IsNil)
+	}
+	qtc.Assert(cache.Put("untagged", defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTagBytes("untagged", "hash", []byte("1")), qt.IsNil)
+	keysWithTag := func(tag string, value squirrel.TagValue, limit int) (keys []string) {
+		qtc.Assert(cache.KeysWithTag(tag, value, func(key string) bool {
+			keys = append(keys, key)
+			return len(keys) < limit
+		}), qt.IsNil)
+		return
+	}
+	qtc.Check(keysWithTag("verified", squirrel.IntTagValue(1), 10), qt.DeepEquals, []string{"chunk0", "chunk2", "chunk3"})
+	qtc.Check(keysWithTag("verified", squirrel.IntTagValue(0), 10), qt.DeepEquals, []string{"chunk1"})
+	qtc.Check(keysWithTag("verified", squirrel.IntTagValue(1), 2), qt.DeepEquals, []string{"chunk0", "chunk2"})
+	qtc.Check(keysWithTag("hash", squirrel.TextTagValue("1"), 10), qt.HasLen, 0)
+	qtc.Check(keysWithTag("hash", squirrel.BytesTagValue([]byte("1")), 10), qt.DeepEquals, []string{"untagged"})
+	// Values read back match themselves.
+	value, ok, err := cache.GetTag("chunk1", "verified")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(ok, qt.IsTrue)
+	qtc.Check(keysWithTag("verified", value, 10), qt.DeepEquals, []string{"chunk1"})
+}
+
+func TestDedup(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.Dedup = true
+	cacheOpts.MaxBlobSize.Set(4)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	checkStats := func(uniqueContents, totalRefs int64) {
+		qtc.Helper()
+		unique, refs, err := cache.DedupStats()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(unique, qt.Equals, uniqueContents)
+		qtc.Check(refs, qt.Equals, totalRefs)
+	}
+	piece := []byte("identical piece data")
+	for _, key := range []string{"a/0", "b/0", "c/0"} {
+		qtc.Assert(cache.Put(key, piece), qt.IsNil)
+	}
+	qtc.Assert(cache.Put("a/1", defaultValue), qt.IsNil)
+	checkStats(2, 4)
+	for _, key := range []string{"a/0", "b/0", "c/0"} {
+		value, err := cache.Get(key)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(value, qt.DeepEquals, piece)
+	}
+	buf := make([]byte, 5)
+	n, err := cache.ReadAt("b/0", buf, 10)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(buf[:n]), qt.Equals, "piece")
+	r, err := cache.NewReader("a/0")
+	qtc.Assert(err, qt.IsNil)
+	value, err := io.ReadAll(r)
+	qtc.Check(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, piece)
+	qtc.Check(r.Close(), qt.IsNil)
+	size, err := cache.KeySize("c/0")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(size, qt.Equals, int64(len(piece)))
+	_, err = cache.OpenPinnedReadOnly("a/0")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrDeduplicated)
+	// The content is kept until the last key referring to it is gone.
+	qtc.Assert(cache.Delete("a/0"), qt.IsNil)
+	qtc.Assert(cache.Put("b/0", defaultValue), qt.IsNil)
+	checkStats(2, 3)
+	value, err = cache.Get("c/0")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, piece)
+	qtc.Assert(cache.Delete("c/0"), qt.IsNil)
+	checkStats(1, 2)
+	// Content values aren't evicted or counted as keys themselves.
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.MaxKeys = 1
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	checkStats(1, 1)
+	value, err = cache.Get("b/0")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+}
+
+func TestInvalidSynchronousMode(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetSynchronous = squirrel.SynchronousExtra + 1
+	_, err := squirrel.NewCache(cacheOpts)
+	qtc.Check(err, qt.ErrorAs, new(squirrel.ErrInvalidPragmaValue))
+	cacheOpts.SetSynchronous = squirrel.SynchronousFull
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Check(squirrel.SynchronousNormal.String(), qt.Equals, "normal")
+}
+
+func TestPageSizeImmutable(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.PageSize = 4096
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	cacheOpts.PageSize = 8192
+	_, err := squirrel.NewCache(cacheOpts)
+	var immutable squirrel.ErrPageSizeImmutable
+	qtc.Assert(err, qt.ErrorAs, &immutable)
+	qtc.Check(immutable, qt.Equals, squirrel.ErrPageSizeImmutable{Existing: 4096, Requested: 8192})
+	cacheOpts.PageSize = 1000
+	_, err = squirrel.NewCache(cacheOpts)
+	qtc.Check(err, qt.ErrorAs, new(squirrel.ErrInvalidPragmaValue))
+	// The existing page size can still be requested.
+	cacheOpts.PageSize = 4096
+	cache = squirrel.TestingNewCache(qtc, cacheOpts)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.PageSize, qt.Equals, int64(4096))
+}
+
+func TestBlobIOFault(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	faultErr := errors.New("injected")
+	var faultOp string
+	squirrel.TestingSetBlobIOFault(&opts, func(op string, off int64) error {
+		if op == faultOp {
+			return faultErr
+		}
+		return nil
+	})
+	cache := squirrel.TestingNewCache(qtc, opts)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	faultOp = "read"
+	_, err := cache.ReadAll(defaultKey, nil)
+	qtc.Check(errors.Is(err, faultErr), qt.IsTrue)
+	faultOp = "write"
+	err = cache.Tx(func(tx *squirrel.Tx) error {
+		pb, err := tx.OpenPinned(defaultKey)
+		qtc.Assert(err, qt.IsNil)
+		defer pb.Close()
+		_, err = pb.WriteAt([]byte("W"), 0)
+		return err
+	})
+	qtc.Check(errors.Is(err, faultErr), qt.IsTrue)
+	faultOp = ""
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+}
+
+func TestTimeSource(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	var now int64
+	cacheOpts.TimeSource = func() int64 {
+		return now
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	for i, key := range []string{"a", "b", "c"} {
+		now = int64(i+1) * 1000
+		qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	}
+	now = 4000
+	_, err := cache.Get("a")
+	qtc.Assert(err, qt.IsNil)
+	var keys []string
+	var lastUseds []int64
+	err = cache.IterByLastUsed(0, func(key string, lastUsed time.Time, accessCount int64) bool {
+		keys = append(keys, key)
+		lastUseds = append(lastUseds, lastUsed.UnixMilli())
+		return true
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"b", "c", "a"})
+	qtc.Check(lastUseds, qt.DeepEquals, []int64{2000, 3000, 4000})
+	qtc.Assert(cache.PutWithTTL("d", defaultValue, time.Second), qt.IsNil)
+	now = 4999
+	_, err = cache.Get("d")
+	qtc.Check(err, qt.IsNil)
+	now = 5000
+	_, err = cache.Get("d")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	// Keys accessed in the transaction report the time source too.
+	now = 6000
+	qtc.Assert(cache.Tx(func(tx *squirrel.Tx) error {
+		pb, err := tx.OpenPinnedReadOnly("a")
+		qtc.Assert(err, qt.IsNil)
+		defer pb.Close()
+		_, err = pb.ReadAt(make([]byte, 1), 0)
+		qtc.Assert(err, qt.IsNil)
+		lastUsed, err := pb.LastUsed()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(lastUsed.UnixMilli(), qt.Equals, int64(6000))
+		return nil
+	}), qt.IsNil)
+}
+
+func TestBinaryKeys(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	// Not valid UTF-8, and contains NULs.
+	key := string([]byte{0xff, 0, 0xfe, 0, 0, 0, 1})
+	qtc.Assert(cache.Put(key, defaultValue), qt.IsNil)
+	value, err := cache.Get(key)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	_, err = cache.Get(key[:len(key)-1])
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	var keys []string
+	qtc.Assert(cache.IterKeys(key[:2], func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{key})
+	qtc.Assert(cache.Delete(key), qt.IsNil)
+	_, err = cache.Get(key)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	// []byte keys refer to the same rows as string keys with the same bytes.
+	b := []byte(key)
+	qtc.Assert(cache.PutBytes(b, defaultValue), qt.IsNil)
+	value, err = cache.Get(string(b))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.DeepEquals, defaultValue)
+	qtc.Assert(cache.Put(string(b), []byte("replaced")), qt.IsNil)
+	value, err = cache.GetBytes(b)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "replaced")
+	value, err = cache.ReadAllBytes(b, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "replaced")
+	_, err = cache.GetBytes(b[:len(b)-1])
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	stats, err := cache.Stats()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(stats.Keys, qt.Equals, int64(1))
+	qtc.Assert(cache.DeleteBytes(b), qt.IsNil)
+	_, err = cache.Get(string(b))
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestCloseAndRemove(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "wal"
+	cache, err := squirrel.NewCache(cacheOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	matches, err := filepath.Glob(cacheOpts.Path + "*")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(matches, qt.Not(qt.HasLen), 0)
+	qtc.Assert(cache.CloseAndRemove(), qt.IsNil)
+	matches, err = filepath.Glob(cacheOpts.Path + "*")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(matches, qt.HasLen, 0)
+	// Again, and after a regular Close.
+	qtc.Check(cache.CloseAndRemove(), qt.IsNil)
+	cache, err = squirrel.NewCache(cacheOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+	qtc.Check(cache.CloseAndRemove(), qt.IsNil)
+	_, err = os.Stat(cacheOpts.Path)
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+	cacheOpts = squirrel.NewCacheOpts{}
+	cacheOpts.MemoryName = t.Name()
+	cache, err = squirrel.NewCache(cacheOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(cache.CloseAndRemove(), qt.IsNil)
+}
+
+func TestReserve(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	// Compare capacity to value lengths alone, so the reservation is what's counted.
+	cacheOpts.CostFunc = func(key string, length int64) int64 {
+		return length
+	}
+	cacheOpts.Capacity = 10 << 10
+	var evicted []string
+	cacheOpts.OnEvict = func(key string, length int64) {
+		evicted = append(evicted, key)
+	}
+	var now int64 = 1000
+	cacheOpts.TimeSource = func() int64 {
+		return now
+	}
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	qtc.Assert(cache.Put("old", make([]byte, 4<<10)), qt.IsNil)
+	now = 2000
+	value := make([]byte, 8<<10)
+	readRandSparse(value)
+	pb, err := cache.Reserve(defaultKey, int64(len(value)))
+	qtc.Assert(err, qt.IsNil)
+	const chunkSize = 1 << 10
+	for off := 0; off < len(value); off += chunkSize {
+		n, err := pb.WriteAt(value[off:off+chunkSize], int64(off))
+		qtc.Assert(err, qt.IsNil)
+		qtc.Assert(n, qt.Equals, chunkSize)
+	}
+	qtc.Assert(pb.Close(), qt.IsNil)
+	// The reservation made room for itself.
+	qtc.Check(evicted, qt.DeepEquals, []string{"old"})
+	_, used, _, err := cache.Capacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(used, qt.Equals, int64(len(value)))
+	b, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	// Reserving again replaces the value with zeroes.
+	pb, err = cache.Reserve(defaultKey, int64(len(value)))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	b, err = cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, make([]byte, len(value)))
+}
+
+func TestGetOrLoad(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	loadErr := errors.New("load failed")
+	_, err := cache.GetOrLoad(defaultKey, func() ([]byte, error) {
+		return nil, loadErr
+	})
+	qtc.Check(err, qt.ErrorIs, loadErr)
+	_, err = cache.Get(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func() ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return defaultValue, nil
+	}
+	var eg errgroup.Group
+	for i := 0; i < 10; i++ {
+		eg.Go(func() error {
+			b, err := cache.GetOrLoad(defaultKey, load)
+			if err == nil && !bytes.Equal(b, defaultValue) {
+				err = fmt.Errorf("got %q", b)
+			}
+			return err
+		})
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	qtc.Assert(eg.Wait(), qt.IsNil)
+	qtc.Check(loads.Load(), qt.Equals, int32(1))
+	b, err := cache.Get(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, defaultValue)
+}
+
+func TestAutoCheckpoint(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.SetJournalMode = "wal"
+	cacheOpts.AutoCheckpointInterval = time.Millisecond
+	cacheOpts.AutoCheckpointMode = squirrel.CheckpointTruncate
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	walSize := func() int64 {
+		fi, err := os.Stat(cacheOpts.Path + "-wal")
+		qtc.Assert(err, qt.IsNil)
+		return fi.Size()
+	}
+	// Checkpoints are skipped while there's a PinnedBlob, so the WAL keeps what's written.
+	qtc.Assert(cache.Put("a", defaultValue), qt.IsNil)
+	pb, err := cache.OpenPinnedReadOnly("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	qtc.Check(walSize(), qt.Not(qt.Equals), int64(0))
+	qtc.Assert(pb.Close(), qt.IsNil)
+	deadline := time.Now().Add(10 * time.Second)
+	for walSize() != 0 {
+		if time.Now().After(deadline) {
+			qtc.Fatal("WAL wasn't checkpointed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cacheOpts.AutoCheckpointMode = "sometimes"
+	_, err = squirrel.NewCache(cacheOpts)
+	qtc.Check(err, qt.ErrorMatches, `unknown checkpoint mode "sometimes"`)
+}
+
+func TestOpenRange(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Compressed=%v", compressed), func(t *testing.T) {
+			qtc := qt.New(t)
+			cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+			// Make the range span blobs.
+			cacheOpts.MaxBlobSize.Set(4)
+			if compressed {
+				cacheOpts.Compression = squirrel.CompressionFlate
+			}
+			cache := squirrel.TestingNewCache(qtc, cacheOpts)
+			qtc.Assert(cache.Put(defaultKey, []byte("hello, world")), qt.IsNil)
+			r, err := cache.OpenRange(defaultKey, 3, 6)
+			qtc.Assert(err, qt.IsNil)
+			b, err := io.ReadAll(r)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(string(b), qt.Equals, "lo, wo")
+			pos, err := r.Seek(-2, io.SeekEnd)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(pos, qt.Equals, int64(4))
+			b, err = io.ReadAll(r)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(string(b), qt.Equals, "wo")
+			qtc.Check(r.Close(), qt.IsNil)
+			// The range is clipped to the value.
+			r, err = cache.OpenRange(defaultKey, 10, 100)
+			qtc.Assert(err, qt.IsNil)
+			b, err = io.ReadAll(r)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(string(b), qt.Equals, "ld")
+			qtc.Check(r.Close(), qt.IsNil)
+			r, err = cache.OpenRange(defaultKey, 20, 1)
+			qtc.Assert(err, qt.IsNil)
+			n, err := r.Read(make([]byte, 1))
+			qtc.Check(n, qt.Equals, 0)
+			qtc.Check(err, qt.Equals, io.EOF)
+			qtc.Check(r.Close(), qt.IsNil)
+			_, err = cache.OpenRange("missing", 0, 1)
+			qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+			_, err = cache.OpenRange(defaultKey, -1, 1)
+			qtc.Check(err, qt.IsNotNil)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package squirrel
+
+import (
+	"math/bits"
+
+	g "github.com/anacrolix/generics"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// The keys with an access count in [MinAccesses, MaxAccesses].
+type AccessBucket struct {
+	MinAccesses int64
+	MaxAccesses int64
+	Keys        int64
+	// The total length of the values for the keys.
+	Bytes int64
+}
+
+// Summarizes the distribution of access counts across keys. Buckets are for 0, 1, 2-3, 4-7 and so
+// on, up to the bucket containing the highest access count. Empty buckets are included. Indexed
+// values and the content shared by deduplicated keys aren't counted.
+func (c *Cache) AccessHistogram() (buckets []AccessBucket, err error) {
+	err = c.withConn(func(c conn) error {
+		return c.sqliteQuery(
+			`select access_count, count(*), sum(length) from keys where key is not null group by access_count`,
+			func(stmt *sqlite.Stmt) error {
+				i := accessBucketIndex(stmt.ColumnInt64(0))
+				for len(buckets) <= i {
+					buckets = append(buckets, newAccessBucket(len(buckets)))
+				}
+				buckets[i].Keys += stmt.ColumnInt64(1)
+				buckets[i].Bytes += stmt.ColumnInt64(2)
+				return nil
+			},
+		)
+	})
+	return
+}
+
+func accessBucketIndex(accesses int64) int {
+	if accesses <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(accesses))
+}
+
+func newAccessBucket(index int) AccessBucket {
+	if index == 0 {
+		return AccessBucket{}
+	}
+	return AccessBucket{
+		MinAccesses: 1 << (index - 1),
+		MaxAccesses: 1<<index - 1,
+	}
+}
+
+// The length of values stored in the database. Values shared by deduplicated keys are only counted
+// once.
+const storedValueBytesSql = `
+	select coalesce(sum(length), 0) from keys
+	where key_id not in (select key_id from key_dedup)
+`
+
+type CacheStats struct {
+	// The total length of stored values, including indexed values. Values shared by deduplicated
+	// keys are only counted once.
+	ValueBytes int64
+	Keys       int64
+	Capacity   g.Option[int64]
+	PageSize   int64
+	// The size of the database file, including free pages.
+	FileSize int64
+}
+
+// Returns an overview of how space is used in the database.
+func (c *Cache) Stats() (stats CacheStats, err error) {
+	err = c.Flush()
+	if err != nil {
+		return
+	}
+	err = c.withConn(func(c conn) (err error) {
+		err = c.sqliteQueryMustOneRow(
+			`select (`+storedValueBytesSql+`), (select count(*) from keys where key is not null)`,
+			func(stmt *sqlite.Stmt) error {
+				stats.ValueBytes = stmt.ColumnInt64(0)
+				stats.Keys = stmt.ColumnInt64(1)
+				return nil
+			},
+		)
+		if err != nil {
+			return
+		}
+		stats.Capacity, err = c.getCapacity()
+		if err != nil {
+			return
+		}
+		stats.PageSize, err = c.execPragmaReturningInt64("page_size")
+		if err != nil {
+			return
+		}
+		pageCount, err := c.execPragmaReturningInt64("page_count")
+		stats.FileSize = pageCount * stats.PageSize
+		return
+	})
+	return
+}
+
+// Returns the length of the value for key.
+func (c *Cache) KeySize(key string) (size int64, err error) {
+	if value, ok := c.writeBehind.get(key); ok {
+		return int64(len(value)), nil
+	}
+	err = c.wrapTxMethod(func(tx *Tx) error {
+		cols, err := tx.conn.openKey(key)
+		size = cols.valueLength()
+		return err
+	})
+	return
+}
+
+// Returns the number of blobs backing the value for key. Values are split into blobs of at most
+// NewConnOpts.MaxBlobSize, and sparse values may have fewer.
+func (c *Cache) ChunkCount(key string) (chunks int, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		cols, err := tx.conn.openKey(key)
+		if err != nil {
+			return
+		}
+		if cols.deduped != nil {
+			cols = *cols.deduped
+		}
+		return tx.conn.sqliteQueryMustOneRow(
+			`select count(*) from "values" where value_id=?`,
+			func(stmt *sqlite.Stmt) error {
+				chunks = stmt.ColumnInt(0)
+				return nil
+			},
+			cols.id,
+		)
+	})
+	return
+}
+
+// Returns the capacity limit, and the total length of stored values. unlimited is true if no
+// capacity is set. The database uses more than the value lengths, and trimming to capacity compares
+// against that (or the total cost if NewCacheOpts.CostFunc is set), so used is approximate.
+func (c *Cache) Capacity() (limit, used int64, unlimited bool, err error) {
+	err = c.withConn(func(c conn) (err error) {
+		capacity, err := c.getCapacity()
+		if err != nil {
+			return
+		}
+		limit, unlimited = capacity.Value, !capacity.Ok
+		return c.sqliteQueryMustOneRow(
+			storedValueBytesSql,
+			func(stmt *sqlite.Stmt) error {
+				used = stmt.ColumnInt64(0)
+				return nil
+			},
+		)
+	})
+	return
+}
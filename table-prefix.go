@@ -0,0 +1,54 @@
+package squirrel
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Matches the names of squirrel's tables and indexes in queries.
+var schemaNameRegexp = regexp.MustCompile(
+	`\b(keys|blobs|setting|tags|tags_name_value|cache_meta|blob_hashes|blob_checksums|key_costs|key_expiries|key_expiries_expires|blob_last_used|key_access_count|key_compression|key_encryption|key_indices|dedup_contents|key_dedup|key_dedup_content|key_dedup_release|key_written_ranges|json_values)\b|"values"`,
+)
+
+// Table prefixes are inserted into queries unquoted, so they're limited to identifier characters.
+var tablePrefixRegexp = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func checkTablePrefix(prefix string) error {
+	if !tablePrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid table prefix %q", prefix)
+	}
+	return nil
+}
+
+// Prefixes the names of squirrel's tables and indexes in query.
+func prefixTableNames(prefix string, query string) string {
+	if prefix == "" {
+		return query
+	}
+	return schemaNameRegexp.ReplaceAllStringFunc(query, func(name string) string {
+		if name == `"values"` {
+			return `"` + prefix + `values"`
+		}
+		return prefix + name
+	})
+}
+
+// Limits the memory used remembering prefixed queries, in case they're not constants.
+const maxPrefixedQueries = 1000
+
+// Applies the conn's table prefix to query. The result is remembered, since queries are usually
+// constants.
+func (conn conn) prefixTableNames(query string) string {
+	if conn.tablePrefix == "" {
+		return query
+	}
+	prefixed, ok := conn.prefixedQueries[query]
+	if !ok {
+		prefixed = prefixTableNames(conn.tablePrefix, query)
+		if conn.prefixedQueries == nil || len(conn.prefixedQueries) >= maxPrefixedQueries {
+			conn.prefixedQueries = make(map[string]string)
+		}
+		conn.prefixedQueries[query] = prefixed
+	}
+	return prefixed
+}
@@ -0,0 +1,179 @@
+package squirrel
+
+import (
+	"strconv"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Calls f with each key that has the tag set, regardless of the tag's value.
+func (c *Cache) IterKeysHavingTag(tag string, f func(key string) error) error {
+	return c.iterKeysQuery(
+		sqlQuery(`
+			select key from keys join tags using (key_id)
+			where tag_name=?
+			order by key`,
+		),
+		f,
+		tag,
+	)
+}
+
+// Calls f with each key that doesn't have the tag set.
+func (c *Cache) IterKeysMissingTag(tag string, f func(key string) error) error {
+	return c.iterKeysQuery(
+		sqlQuery(`
+			select key from keys left join tags on keys.key_id=tags.key_id and tag_name=?
+			where tags.key_id is null and key is not null
+			order by key`,
+		),
+		f,
+		tag,
+	)
+}
+
+// Calls f with each key that has the tag set to value, in order, until f returns false. Values match
+// if they have the same sqlite type: booleans are stored as integers, and text doesn't match bytes.
+// The keys are collected before f is called, so f can use the Cache.
+func (c *Cache) KeysWithTag(tag string, value TagValue, f func(key string) bool) (err error) {
+	err = c.iterKeysQuery(
+		sqlQuery(`
+			select key from tags join keys using (key_id)
+			where tag_name=? and value is ?
+			order by key`,
+		),
+		func(key string) error {
+			if !f(key) {
+				return errStopIter
+			}
+			return nil
+		},
+		tag,
+		value.arg(),
+	)
+	if err == errStopIter {
+		err = nil
+	}
+	return
+}
+
+// The value of a tag, converted as sqlite does for the accessor used.
+type TagValue struct {
+	int   int64
+	bytes []byte
+	// The sqlite type of the value, as returned by typeof.
+	typ string
+}
+
+func IntTagValue(i int64) TagValue {
+	return TagValue{int: i, bytes: strconv.AppendInt(nil, i, 10), typ: "integer"}
+}
+
+func TextTagValue(s string) TagValue {
+	i, _ := strconv.ParseInt(s, 10, 64)
+	return TagValue{int: i, bytes: []byte(s), typ: "text"}
+}
+
+func BytesTagValue(b []byte) TagValue {
+	i, _ := strconv.ParseInt(string(b), 10, 64)
+	return TagValue{int: i, bytes: b, typ: "blob"}
+}
+
+// Returns the value as it would have been passed to SetTag. The zero TagValue is NULL.
+func (v TagValue) arg() any {
+	switch v.typ {
+	case "integer":
+		return v.int
+	case "real":
+		f, _ := strconv.ParseFloat(string(v.bytes), 64)
+		return f
+	case "text":
+		return string(v.bytes)
+	case "blob":
+		return v.bytes
+	default:
+		return nil
+	}
+}
+
+func (v TagValue) Int() int64 {
+	return v.int
+}
+
+func (v TagValue) Bytes() []byte {
+	return v.bytes
+}
+
+func (v TagValue) Text() string {
+	return string(v.bytes)
+}
+
+func (c *Cache) SetTagInt(key, name string, value int64) error {
+	return c.SetTag(key, name, value)
+}
+
+func (c *Cache) SetTagBytes(key, name string, value []byte) error {
+	return c.SetTag(key, name, value)
+}
+
+// Returns the value of the tag on key, and whether the tag is set. Returns ErrNotFound if the key
+// doesn't exist.
+func (c *Cache) GetTag(key, name string) (value TagValue, ok bool, err error) {
+	err = c.wrapTxMethod(func(tx *Tx) (err error) {
+		value, ok, err = tx.GetTag(key, name)
+		return
+	})
+	return
+}
+
+func (tx *Tx) GetTag(key, name string) (value TagValue, ok bool, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	ok, err = tx.conn.sqliteQueryRow(
+		`select value, typeof(value) from tags where key_id=? and tag_name=?`,
+		func(stmt *sqlite.Stmt) error {
+			value = tagValueFromStmtColumn(stmt, 0)
+			return nil
+		},
+		cols.id,
+		name,
+	)
+	return
+}
+
+// Reads the tag value at col, and its type from typeof(value) at the column after.
+func tagValueFromStmtColumn(stmt *sqlite.Stmt, col int) (value TagValue) {
+	value.int = stmt.ColumnInt64(col)
+	value.bytes = make([]byte, stmt.ColumnLen(col))
+	stmt.ColumnBytes(col, value.bytes)
+	value.typ = stmt.ColumnText(col + 1)
+	return
+}
+
+// Returns all the tags on key by name. Returns ErrNotFound if the key doesn't exist.
+func (c *Cache) GetTags(key string) (tags map[string]TagValue, err error) {
+	err = c.wrapTxMethod(func(tx *Tx) (err error) {
+		tags, err = tx.GetTags(key)
+		return
+	})
+	return
+}
+
+func (tx *Tx) GetTags(key string) (tags map[string]TagValue, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	tags = make(map[string]TagValue)
+	err = tx.conn.sqliteQuery(
+		`select tag_name, value, typeof(value) from tags where key_id=?`,
+		func(stmt *sqlite.Stmt) error {
+			tags[stmt.ColumnText(0)] = tagValueFromStmtColumn(stmt, 1)
+			return nil
+		},
+		cols.id,
+	)
+	return
+}
@@ -27,6 +27,18 @@ func TestingNewCache(c *qt.C, opts NewCacheOpts) *Cache {
 	return cache
 }
 
+// Makes blob reads and writes by the Cache fail with the error returned by f, if it's not nil. op
+// is "read" or "write", and off is the offset in the blob. This is for testing error handling.
+func TestingSetBlobIOFault(opts *NewCacheOpts, f func(op string, off int64) error) {
+	opts.blobIOFault = f
+}
+
+// Makes the Cache prepare every statement each time it's run, instead of reusing them. This is for
+// measuring what statement reuse saves.
+func TestingSetTransientStatements(opts *NewCacheOpts) {
+	opts.transientStatements = true
+}
+
 func TestingTempCachePath(c testing.TB) string {
 	if cleanupDatabases {
 		// Put the database in the test temp dir, so it gets removed automatically.
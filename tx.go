@@ -5,10 +5,13 @@ import (
 	g "github.com/anacrolix/generics"
 	sqlite "github.com/go-llsqlite/adapter"
 	"io"
+	"sync"
 	"time"
 )
 
 type Tx struct {
+	// Serializes use of conn by PinnedBlobs opened in the Tx, which may be used concurrently.
+	mu           sync.Mutex
 	conn         conn
 	accessedKeys map[rowid]struct{}
 	write        bool
@@ -16,13 +19,25 @@ type Tx struct {
 
 type CreateOpts struct {
 	Length int64
+	// Don't allocate storage for the value up front. Blobs are allocated as writes cover them, so
+	// unwritten regions consume no storage. See NewCacheOpts.SparseReadsErr for how unwritten
+	// regions are read.
+	Sparse bool
 }
 
+// Returns a PinnedBlob for a value of length opts.Length, reusing the existing value if it has that
+// length. Writes to new values through PinnedBlobs are tracked, see Tx.WrittenRanges.
 func (tx *Tx) Create(name string, opts CreateOpts) (pb *PinnedBlob, err error) {
-	keyId, err := tx.conn.createKey(name, opts)
+	keyId, created, err := tx.conn.createKey(name, opts)
 	if err != nil {
 		return
 	}
+	if created {
+		err = tx.conn.trackWrittenRanges(keyId)
+		if err != nil {
+			return
+		}
+	}
 	pb = &PinnedBlob{
 		key:     name,
 		write:   true,
@@ -56,12 +71,36 @@ func (tx *Tx) Put(name string, b []byte) (err error) {
 	if err != nil && err != ErrNotFound {
 		return
 	}
-	pb, err := tx.Create(name, CreateOpts{int64(len(b))})
+	if tx.conn.dedup && len(b) != 0 {
+		return tx.putDeduped(name, b)
+	}
+	stored, compression, err := tx.conn.compressValue(b)
+	if err != nil {
+		return
+	}
+	var keyId rowid
+	if tx.conn.blobCrypter != nil && len(stored) != 0 {
+		keyId, err = tx.conn.putEncrypted(name, stored)
+	} else {
+		keyId, err = tx.putStored(name, stored)
+	}
 	if err != nil {
 		return
 	}
-	_, err = pb.WriteAt(b, 0)
-	err = errors.Join(err, pb.Close())
+	return tx.conn.storeKeyCompression(keyId, compression, int64(len(b)))
+}
+
+// Writes b as the stored value for name. It's written in full, so written ranges aren't tracked.
+func (tx *Tx) putStored(name string, b []byte) (keyId rowid, err error) {
+	keyId, _, err = tx.conn.createKey(name, CreateOpts{Length: int64(len(b))})
+	if err != nil || len(b) == 0 {
+		return
+	}
+	_, err = tx.conn.valueIoAt(keyId, int64(len(b)), b, 0, true)
+	if err != nil {
+		return
+	}
+	g.MakeMapIfNilAndSet(&tx.accessedKeys, keyId, struct{}{})
 	return
 }
 
@@ -71,46 +110,74 @@ func (tx *Tx) ReadAll(key string, b []byte) (ret []byte, err error) {
 	if err != nil {
 		return
 	}
-	if int64(len(b)) < keyCols.length {
-		b = make([]byte, keyCols.length)
+	length := keyCols.valueLength()
+	if int64(len(b)) < length {
+		b = make([]byte, length)
 	} else {
-		b = b[:keyCols.length]
+		b = b[:length]
 	}
-	n, err := tx.readFull(keyCols.id, b)
+	n, err := tx.readFull(keyCols, b)
 	ret = b[:n]
 	return
 }
 
+// Updates the last use and access count of key, as reading it would, so it's less likely to be
+// evicted. Returns ErrNotFound if it doesn't exist.
+func (tx *Tx) Touch(key string) (err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+	return
+}
+
+// Returns the value for key in a new slice, which is empty rather than nil for empty values. Unlike
+// ReadAll, this counts as an access.
+func (tx *Tx) Get(key string) (b []byte, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	b = make([]byte, cols.valueLength())
+	_, err = tx.readFull(cols, b)
+	if err != nil {
+		return nil, err
+	}
+	g.MakeMapIfNilAndSet(&tx.accessedKeys, cols.id, struct{}{})
+	return
+}
+
+// Reads len(b) bytes from the start of the value. Returns ErrShortValue if the value is shorter
+// than b.
 func (tx *Tx) ReadFull(key string, b []byte) (n int, err error) {
-	valueId, err := tx.conn.getValueIdForKey(key)
+	keyCols, err := tx.conn.openKey(key)
 	if err != nil {
 		return
 	}
-	return tx.readFull(valueId, b)
-}
-
-func (tx *Tx) readFull(valueId rowid, b []byte) (n int, err error) {
-	var nextOff int64
-	b0 := b
-	err = tx.conn.iterBlobs(
-		valueId,
-		func(offset int64, blob *sqlite.Blob) (more bool, err error) {
-			if offset > nextOff {
-				err = io.EOF
-				return
-			}
-			n1, err := blob.ReadAt(b, nextOff-offset)
-			n += n1
-			b = b[n1:]
-			nextOff += int64(n1)
-			more = len(b) != 0
-			return
-		},
-		false,
-		0,
-	)
+	n, err = tx.readFull(keyCols, b)
+	if err == io.ErrUnexpectedEOF {
+		err = ErrShortValue{
+			Key:  key,
+			Have: keyCols.valueLength(),
+			Want: int64(len(b)),
+		}
+	}
+	return
+}
+
+// Reads len(b) bytes from the start of the value. Returns io.ErrUnexpectedEOF if the value is
+// shorter than b.
+func (tx *Tx) readFull(key keyCols, b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return
+	}
+	if key.checkPinnable() != nil {
+		return tx.readFullDecoded(key, b)
+	}
+	n, err = tx.conn.valueIoAt(key.id, key.length, b, 0, false)
 	if err == io.EOF {
-		if n == len(b0) {
+		if n == len(b) {
 			err = nil
 		} else {
 			err = io.ErrUnexpectedEOF
@@ -133,6 +200,16 @@ func (tx *Tx) SetTag(key, name string, value any) (err error) {
 	)
 }
 
+// Removes the tag from key. It's not an error if the tag or key doesn't exist. This doesn't count
+// as an access.
+func (tx *Tx) DeleteTag(key, name string) error {
+	return tx.conn.sqliteExec(
+		"delete from tags where key_id=(select key_id from keys where key=?) and tag_name=?",
+		key,
+		name,
+	)
+}
+
 func (tx *Tx) Delete(name string) (err error) {
 	return tx.conn.deleteKey(name)
 }
@@ -149,8 +226,47 @@ func (tx *Tx) OpenPinnedReadOnly(name string) (ret *PinnedBlob, err error) {
 	return tx.openPinned(name, false)
 }
 
+// Returns a writable PinnedBlob for the value, after extending it to at least minLength with zeroed
+// blobs. The value is created if it doesn't exist. You must call PinnedBlob.Close when done with it.
+func (tx *Tx) OpenPinnedWritable(name string, minLength int64) (ret *PinnedBlob, err error) {
+	cols, err := tx.conn.openKey(name)
+	if errors.Is(err, ErrNotFound) {
+		return tx.Create(name, CreateOpts{Length: minLength})
+	}
+	if err != nil {
+		return
+	}
+	err = cols.checkPinnable()
+	if err != nil {
+		return
+	}
+	err = tx.conn.growValue(cols, minLength)
+	if err != nil {
+		return
+	}
+	return tx.openPinned(name, true)
+}
+
+// Replaces the value for key with zeroes of length, allocating its storage up front. Writes to it
+// through PinnedBlobs are tracked, see Tx.WrittenRanges.
+func (tx *Tx) Reserve(key string, length int64) (err error) {
+	err = tx.Delete(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return
+	}
+	keyId, _, err := tx.conn.createKey(key, CreateOpts{Length: length})
+	if err != nil {
+		return
+	}
+	return tx.conn.trackWrittenRanges(keyId)
+}
+
 func (tx *Tx) lastUsed(keyId rowid) (t time.Time, err error) {
 	if g.MapContains(tx.accessedKeys, keyId) {
+		// The access is recorded when the transaction ends, with the same clock.
+		if tx.conn.timeSource != nil {
+			return time.UnixMilli(tx.conn.timeSource()), nil
+		}
 		return time.Now(), nil
 	}
 	return tx.conn.lastUsed(keyId)
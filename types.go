@@ -3,8 +3,22 @@ package squirrel
 type rowid = int64
 
 type keyCols struct {
-	id     rowid
-	length int64
+	id rowid
+	// The stored length, which is the compressed length for compressed values.
+	length             int64
+	compression        Compression
+	uncompressedLength int64
+	encrypted          bool
+	// The content value storing the value, if it's deduplicated.
+	deduped *keyCols
+}
+
+// Returns the length of the value as seen by callers.
+func (cols keyCols) valueLength() int64 {
+	if cols.compression != CompressionNone {
+		return cols.uncompressedLength
+	}
+	return cols.length
 }
 
 // sqlite3 mentions this might be limited to 2<<31-1. By default it's actually limited to 1e9. The
@@ -15,3 +29,18 @@ type valueKey struct {
 	keyId  rowid
 	offset int64
 }
+
+// Returns an error if the stored bytes don't correspond to the value's offsets, so it can't be
+// accessed in place.
+func (cols keyCols) checkPinnable() error {
+	if cols.compression != CompressionNone {
+		return ErrCompressed
+	}
+	if cols.encrypted {
+		return ErrEncrypted
+	}
+	if cols.deduped != nil {
+		return ErrDeduplicated
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package squirrel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Returns a SHA-256 hash over the hashes of the blobs backing the value. Blob hashes are stored, and
+// only recomputed for blobs that have been written since, so this is cheap for large values that
+// are only partially updated. The result depends on how the value is divided into blobs, so it's
+// only comparable between values with the same layout.
+func (c *Cache) ValueHash(key string) (ret []byte, err error) {
+	err = c.TxImmediate(func(tx *Tx) error {
+		ret, err = tx.ValueHash(key)
+		return err
+	})
+	return
+}
+
+func (tx *Tx) ValueHash(key string) (ret []byte, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	if cols.deduped != nil {
+		cols = *cols.deduped
+	}
+	type blobHash struct {
+		blobId rowid
+		offset int64
+		length int64
+		hash   []byte
+	}
+	var blobs []blobHash
+	err = tx.conn.sqliteQuery(
+		sqlQuery(`
+			select blob_id, offset, length(blob), hash
+			from "values" join blobs using (blob_id) left join blob_hashes using (blob_id)
+			where value_id=?
+			order by offset`,
+		),
+		func(stmt *sqlite.Stmt) error {
+			bh := blobHash{
+				blobId: stmt.ColumnInt64(0),
+				offset: stmt.ColumnInt64(1),
+				length: stmt.ColumnInt64(2),
+			}
+			if stmt.ColumnType(3) != sqlite.TypeNull {
+				bh.hash = make([]byte, stmt.ColumnLen(3))
+				stmt.ColumnBytes(3, bh.hash)
+			}
+			blobs = append(blobs, bh)
+			return nil
+		},
+		cols.id,
+	)
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	for _, bh := range blobs {
+		if bh.hash == nil {
+			bh.hash, err = tx.conn.hashBlob(bh.blobId)
+			if err != nil {
+				return
+			}
+		}
+		var header [16]byte
+		binary.BigEndian.PutUint64(header[:8], uint64(bh.offset))
+		binary.BigEndian.PutUint64(header[8:], uint64(bh.length))
+		h.Write(header[:])
+		h.Write(bh.hash)
+	}
+	ret = h.Sum(nil)
+	return
+}
+
+// Computes and stores the hash of a blob.
+func (conn conn) hashBlob(blobId rowid) (hash []byte, err error) {
+	err = conn.sqliteQueryMustOneRow(
+		`select blob from blobs where blob_id=?`,
+		func(stmt *sqlite.Stmt) error {
+			b := make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, b)
+			sum := sha256.Sum256(b)
+			hash = sum[:]
+			return nil
+		},
+		blobId,
+	)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(`insert or replace into blob_hashes (blob_id, hash) values (?, ?)`, blobId, hash)
+	if err == nil {
+		conn.hasBlobHashes.Set(true)
+	}
+	return
+}
+
+// Forgets the stored hashes of blobs overlapping [start, end) in the value.
+func (conn conn) invalidateBlobHashes(valueId rowid, start, end int64) error {
+	// Hashes are only stored by ValueHash, so there's usually nothing to do.
+	has, err := conn.tableHasRows("blob_hashes", &conn.hasBlobHashes)
+	if err != nil || !has {
+		return err
+	}
+	return conn.sqliteExec(
+		sqlQuery(`
+			delete from blob_hashes where blob_id in (
+				select blob_id from "values"
+				where value_id=?1 and offset<?2 and offset>=(
+					select coalesce(max(offset), 0) from "values" where value_id=?1 and offset<=?3
+				)
+			)`,
+		),
+		valueId, end, start,
+	)
+}
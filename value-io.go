@@ -0,0 +1,275 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Reads or writes b at off in the value. Regions of sparse values that aren't backed by blobs are
+// allocated when writing, and read as zeroes or ErrNotPresent. Returns io.EOF if the value ends
+// before b is filled.
+func (conn conn) valueIoAt(valueId rowid, length int64, b []byte, off int64, write bool) (n int, err error) {
+	if off >= length {
+		err = io.EOF
+		return
+	}
+	if int64(len(b)) > length-off {
+		b = b[:length-off]
+		defer func() {
+			if err == nil {
+				err = io.EOF
+			}
+		}()
+	}
+	if write {
+		err = conn.invalidateBlobHashes(valueId, off, off+int64(len(b)))
+		if err != nil {
+			return
+		}
+		err = conn.invalidateBlobChecksums(valueId, off, off+int64(len(b)))
+		if err != nil {
+			return
+		}
+		if conn.verifyChecksums {
+			start, end := off, off+int64(len(b))
+			defer func() {
+				if err == nil {
+					err = conn.addUnchecksummedBlobs(valueId, start, end)
+				}
+			}()
+		}
+	}
+	allocatedOff := g.None[int64]()
+	for len(b) != 0 {
+		var n1 int
+		n1, err = conn.blobsIoAt(valueId, b, off, write)
+		n += n1
+		b = b[n1:]
+		off += int64(n1)
+		if err != nil || len(b) == 0 {
+			return
+		}
+		if n1 != 0 {
+			// We stopped at a gap. Go around again to handle it.
+			continue
+		}
+		// off isn't backed by a blob.
+		if write {
+			if allocatedOff.Ok && allocatedOff.Value == off {
+				err = errors.New("allocated blobs don't cover write")
+				return
+			}
+			err = conn.allocateValueRange(valueId, off, off+int64(len(b)), length)
+			if err != nil {
+				return
+			}
+			allocatedOff.Set(off)
+			continue
+		}
+		if conn.sparseReadsErr {
+			err = ErrNotPresent
+			return
+		}
+		var next int64
+		next, err = conn.nextBlobOffset(valueId, off, length)
+		if err != nil {
+			return
+		}
+		zeroes := b[:g.Min(int64(len(b)), next-off)]
+		for i := range zeroes {
+			zeroes[i] = 0
+		}
+		n += len(zeroes)
+		b = b[len(zeroes):]
+		off += int64(len(zeroes))
+	}
+	return
+}
+
+// Reads or writes the blobs backing the value contiguously from off, stopping at the first region
+// not backed by a blob.
+func (conn conn) blobsIoAt(valueId rowid, b []byte, valueOff int64, write bool) (n int, err error) {
+	state := &conn.blobsIo
+	*state = blobsIoState{
+		conn:     conn,
+		b:        b,
+		valueOff: valueOff,
+		write:    write,
+	}
+	err = conn.iterBlobs(valueId, conn.blobsIoIter, write, valueOff)
+	n = state.n
+	// Don't hold on to the caller's buffer.
+	state.b = nil
+	return
+}
+
+// The progress of blobsIoAt. It's kept in the conn with its iter method bound, so that reads and
+// writes don't allocate a closure and its captured variables for each call.
+type blobsIoState struct {
+	conn     conn
+	b        []byte
+	valueOff int64
+	n        int
+	write    bool
+}
+
+func (me *blobsIoState) iter(blobOff int64, blob *sqlite.Blob) (more bool, err error) {
+	readOff := me.valueOff - blobOff
+	if readOff < 0 {
+		return false, nil
+	}
+	if readOff >= blob.Size() {
+		return true, nil
+	}
+	b1 := me.b
+	if int64(len(b1)) > blob.Size()-readOff {
+		b1 = me.b[:blob.Size()-readOff]
+	}
+	var n1 int
+	if me.write {
+		n1, err = me.conn.blobWriteAt(blob, b1, readOff)
+	} else {
+		n1, err = me.conn.blobReadAt(blob, b1, readOff)
+	}
+	me.n += n1
+	me.b = me.b[n1:]
+	me.valueOff += int64(n1)
+	if n1 == len(b1) && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	more = len(me.b) != 0
+	return
+}
+
+// Returns the offset of the first blob after off in the value, or length if there isn't one.
+func (conn conn) nextBlobOffset(valueId rowid, off int64, length int64) (next int64, err error) {
+	next = length
+	err = conn.sqliteQueryMaxOneRow(
+		`select offset from "values" where value_id=? and offset>? order by offset limit 1`,
+		func(stmt *sqlite.Stmt) error {
+			next = stmt.ColumnInt64(0)
+			return nil
+		},
+		valueId, off,
+	)
+	return
+}
+
+// Allocates zeroed blobs for any part of [off, end) in the value that isn't backed by a blob. New
+// blobs are extended to multiples of maxBlobSize where that doesn't overlap existing blobs.
+func (conn conn) allocateValueRange(valueId rowid, off, end, length int64) (err error) {
+	lo := off - off%conn.maxBlobSize
+	hi := g.Min(length, (end+conn.maxBlobSize-1)/conn.maxBlobSize*conn.maxBlobSize)
+	// Collect the existing blobs first, so we're not inserting while the query is running.
+	var existing [][2]int64
+	err = conn.sqliteQuery(
+		sqlQuery(`
+			select offset, offset+length(blob)
+			from "values" join blobs using (blob_id)
+			where value_id=? and offset<? and offset+length(blob)>?
+			order by offset`,
+		),
+		func(stmt *sqlite.Stmt) error {
+			existing = append(existing, [2]int64{stmt.ColumnInt64(0), stmt.ColumnInt64(1)})
+			return nil
+		},
+		valueId, hi, lo,
+	)
+	if err != nil {
+		return
+	}
+	next := lo
+	for _, blob := range existing {
+		if blob[0] > next {
+			err = conn.allocateBlobs(valueId, next, blob[0])
+			if err != nil {
+				return
+			}
+		}
+		next = g.Max(next, blob[1])
+	}
+	if next < hi {
+		err = conn.allocateBlobs(valueId, next, hi)
+	}
+	return
+}
+
+// Extends the value to newLength with zeroes. The last blob is grown first, so values extended in
+// small steps aren't split into many small blobs, and zeroed blobs are allocated for the rest.
+func (conn conn) growValue(key keyCols, newLength int64) (err error) {
+	if newLength <= key.length {
+		return
+	}
+	err = conn.sqliteExec(`update keys set length=? where key_id=?`, newLength, key.id)
+	if err != nil {
+		return
+	}
+	err = conn.storeKeyCost(key.id)
+	if err != nil {
+		return
+	}
+	allocateFrom, err := conn.extendLastBlob(key, newLength)
+	if err != nil {
+		return
+	}
+	return conn.allocateBlobs(key.id, allocateFrom, newLength)
+}
+
+// Grows the blob at the end of the value towards newLength, up to the next multiple of
+// maxBlobSize, where allocateBlobs would have split it. Returns the end of the blob.
+func (conn conn) extendLastBlob(key keyCols, newLength int64) (end int64, err error) {
+	end = key.length
+	var blobId, offset, size int64
+	ok, err := conn.sqliteQueryRow(
+		`
+			select blob_id, offset, length(blob) from "values" join blobs using (blob_id)
+			where value_id=? order by offset desc limit 1`,
+		func(stmt *sqlite.Stmt) error {
+			blobId = stmt.ColumnInt64(0)
+			offset = stmt.ColumnInt64(1)
+			size = stmt.ColumnInt64(2)
+			return nil
+		},
+		key.id,
+	)
+	// Nothing to grow if the value is empty, or has a gap at the end.
+	if err != nil || !ok || offset+size != key.length {
+		return
+	}
+	end = g.Min(newLength, (offset/conn.maxBlobSize+1)*conn.maxBlobSize)
+	if end <= key.length {
+		end = key.length
+		return
+	}
+	// The stored hash and checksum are for the blob's old contents.
+	err = conn.invalidateBlobHashes(key.id, offset, key.length)
+	if err != nil {
+		return
+	}
+	err = conn.invalidateBlobChecksums(key.id, offset, key.length)
+	if err != nil {
+		return
+	}
+	// Open handles expire when the blob is replaced.
+	err = conn.forgetBlobsForKeyId(key.id)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(
+		`update blobs set blob=cast(blob || zeroblob(?) as blob) where blob_id=?`,
+		end-key.length, blobId,
+	)
+	if err != nil {
+		return
+	}
+	if conn.verifyChecksums {
+		g.MakeMapIfNilAndSet(&conn.unchecksummedBlobs, blobId, struct{}{})
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package squirrel
+
+import (
+	"bytes"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/sync"
+)
+
+type WriteBehindOpts struct {
+	// Buffered values are flushed when their total length reaches this. Zero means no limit.
+	MaxBytes int64
+	// Buffered values are flushed at most this long after the first is buffered. Zero means no
+	// limit.
+	MaxDelay time.Duration
+}
+
+// Buffers Puts in memory so they can be written in a single transaction.
+type writeBehind struct {
+	mu      sync.Mutex
+	pending map[string][]byte
+	// Values being written by a flush. They remain readable from here until the flush completes.
+	flushing map[string][]byte
+	bytes    int64
+	timer    *time.Timer
+	// Serializes flushes.
+	flushMu sync.Mutex
+}
+
+// Returns the buffered value for key, if there is one.
+func (wb *writeBehind) get(key string) (b []byte, ok bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	b, ok = wb.pending[key]
+	if ok {
+		return
+	}
+	b, ok = wb.flushing[key]
+	return
+}
+
+func (c *Cache) putWriteBehind(key string, b []byte) error {
+	// Nothing would flush the value.
+	if c.isClosed() {
+		return ErrClosed
+	}
+	opts := c.opts.WriteBehind.Value
+	wb := &c.writeBehind
+	wb.mu.Lock()
+	if old, ok := wb.pending[key]; ok {
+		wb.bytes -= int64(len(old))
+	}
+	g.MakeMapIfNilAndSet(&wb.pending, key, bytes.Clone(b))
+	wb.bytes += int64(len(b))
+	full := opts.MaxBytes > 0 && wb.bytes >= opts.MaxBytes
+	if !full && opts.MaxDelay > 0 && wb.timer == nil {
+		wb.timer = time.AfterFunc(opts.MaxDelay, c.flushWriteBehindOnTimer)
+	}
+	wb.mu.Unlock()
+	if full {
+		return c.Flush()
+	}
+	return nil
+}
+
+func (c *Cache) flushWriteBehindOnTimer() {
+	err := c.Flush()
+	if err != nil {
+		c.opts.Logger.Levelf(log.Error, "flushing write-behind buffer: %v", err)
+	}
+}
+
+// Writes any values buffered by NewCacheOpts.WriteBehind to the database in a single transaction.
+// If the flush fails, the values remain buffered.
+func (c *Cache) Flush() (err error) {
+	if !c.opts.WriteBehind.Ok {
+		return nil
+	}
+	wb := &c.writeBehind
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+	wb.mu.Lock()
+	flushing := wb.pending
+	wb.flushing = flushing
+	wb.pending = nil
+	wb.bytes = 0
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+	wb.mu.Unlock()
+	if len(flushing) == 0 {
+		return nil
+	}
+	err = c.txImmediate(func(tx *Tx) error {
+		for key, b := range flushing {
+			err := tx.Put(key, b)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.flushing = nil
+	if err != nil {
+		// Restore the values that weren't replaced while we were flushing.
+		for key, b := range flushing {
+			if g.MapContains(wb.pending, key) {
+				continue
+			}
+			g.MakeMapIfNilAndSet(&wb.pending, key, b)
+			wb.bytes += int64(len(b))
+		}
+	}
+	return
+}
+
+// Reads a buffered value in the manner of ReadFull.
+func readFullFromBuffer(key string, value []byte, b []byte) (n int, err error) {
+	n = copy(b, value)
+	if n < len(b) {
+		err = ErrShortValue{
+			Key:  key,
+			Have: int64(len(value)),
+			Want: int64(len(b)),
+		}
+	}
+	return
+}
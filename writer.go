@@ -0,0 +1,82 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+
+	g "github.com/anacrolix/generics"
+)
+
+// Appends to a value in its own write transaction, a blob at a time.
+type valueWriter struct {
+	pb CachePinnedBlob
+	// Bytes that haven't filled a blob yet.
+	buf    []byte
+	length int64
+	err    error
+}
+
+func (w *valueWriter) Write(b []byte) (n int, err error) {
+	if w.pb.PinnedBlob == nil {
+		return 0, ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	maxBlobSize := int(w.pb.tx.conn.maxBlobSize)
+	for len(b) != 0 {
+		m := g.Min(len(b), maxBlobSize-len(w.buf))
+		w.buf = append(w.buf, b[:m]...)
+		b = b[m:]
+		n += m
+		if len(w.buf) == maxBlobSize {
+			err = w.flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Appends the buffered bytes to the value.
+func (w *valueWriter) flush() (err error) {
+	if len(w.buf) == 0 {
+		return
+	}
+	conn := w.pb.tx.conn
+	newLength := w.length + int64(len(w.buf))
+	err = conn.growValue(keyCols{id: w.pb.valueId, length: w.length}, newLength)
+	if err == nil {
+		_, err = conn.valueIoAt(w.pb.valueId, newLength, w.buf, w.length, true)
+	}
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.length = newLength
+	w.buf = w.buf[:0]
+	return
+}
+
+// Commits what has been written.
+func (w *valueWriter) Close() error {
+	if w.pb.PinnedBlob == nil {
+		return ErrClosed
+	}
+	err := w.flush()
+	err = errors.Join(err, w.pb.Close())
+	w.pb.PinnedBlob = nil
+	return err
+}
+
+// Returns a writer that replaces the value for key with the bytes written to it, which needn't be
+// known in advance. The value is committed when the writer is closed, and until then the writer
+// holds a write transaction open.
+func (c *Cache) NewWriter(key string) (io.WriteCloser, error) {
+	pb, err := c.Create(key, CreateOpts{})
+	if err != nil {
+		return nil, err
+	}
+	return &valueWriter{pb: pb}, nil
+}
@@ -0,0 +1,115 @@
+package squirrel
+
+import (
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Values created with Tx.Create (including through Blobs and OpenPinnedWritable) record the regions
+// written through PinnedBlobs, so it's known which parts are data and which are zero-filled. Values
+// written in full, like with Put, aren't tracked and are complete. Extending a value that isn't
+// tracked doesn't start tracking it.
+
+// Starts tracking the written ranges of a new value. The empty range marks the value as tracked.
+func (conn conn) trackWrittenRanges(keyId rowid) error {
+	return conn.sqliteExec(
+		`insert or ignore into key_written_ranges (key_id, offset, length) values (?, 0, 0)`,
+		keyId,
+	)
+}
+
+// Merges [off, off+length) into the written ranges of the value if they're tracked.
+func (conn conn) recordWritten(keyId rowid, off, length int64) (err error) {
+	start, end := off, off+length
+	var tracked bool
+	// Find the ranges touching the new one, including the empty one marking the value as tracked.
+	err = conn.sqliteQuery(
+		`
+			select offset, offset+length from key_written_ranges
+			where key_id=? and offset<=? and offset+length>=?`,
+		func(stmt *sqlite.Stmt) error {
+			tracked = true
+			start = g.Min(start, stmt.ColumnInt64(0))
+			end = g.Max(end, stmt.ColumnInt64(1))
+			return nil
+		},
+		keyId, end, start,
+	)
+	if err != nil {
+		return
+	}
+	if !tracked {
+		tracked, err = conn.writtenRangesTracked(keyId)
+		if err != nil || !tracked {
+			return
+		}
+	}
+	err = conn.sqliteExec(
+		`delete from key_written_ranges where key_id=? and offset<=? and offset+length>=?`,
+		keyId, end, start,
+	)
+	if err != nil {
+		return
+	}
+	return conn.sqliteExec(
+		`insert into key_written_ranges (key_id, offset, length) values (?, ?, ?)`,
+		keyId, start, end-start,
+	)
+}
+
+func (conn conn) writtenRangesTracked(keyId rowid) (tracked bool, err error) {
+	err = conn.sqliteQueryMaxOneRow(
+		`select 1 from key_written_ranges where key_id=? limit 1`,
+		func(stmt *sqlite.Stmt) error {
+			tracked = true
+			return nil
+		},
+		keyId,
+	)
+	return
+}
+
+// Returns the regions of the value that have been written, in order. Values that aren't tracked
+// are entirely written. Unlike PresentRanges, this doesn't include zero-filled regions of values
+// that aren't sparse.
+func (tx *Tx) WrittenRanges(key string) (ret []Range, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	tracked := false
+	err = tx.conn.sqliteQuery(
+		`select offset, length from key_written_ranges where key_id=? order by offset`,
+		func(stmt *sqlite.Stmt) error {
+			tracked = true
+			r := Range{Off: stmt.ColumnInt64(0), Len: stmt.ColumnInt64(1)}
+			if r.Len != 0 {
+				ret = append(ret, r)
+			}
+			return nil
+		},
+		cols.id,
+	)
+	if err != nil || tracked {
+		return
+	}
+	if length := cols.valueLength(); length != 0 {
+		ret = []Range{{Off: 0, Len: length}}
+	}
+	return
+}
+
+// Returns whether the entire value has been written. See Tx.WrittenRanges.
+func (tx *Tx) IsComplete(key string) (complete bool, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	ranges, err := tx.WrittenRanges(key)
+	if err != nil {
+		return
+	}
+	length := cols.valueLength()
+	complete = length == 0 || len(ranges) == 1 && ranges[0] == Range{Off: 0, Len: length}
+	return
+}